@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const identityKey = "identity"
+
+// Roles, each can do everything the ones before it can
+const (
+	roleViewer = iota + 1
+	roleOperator
+	roleAdmin
+)
+
+var roleNames = map[string]int{
+	"viewer":   roleViewer,
+	"operator": roleOperator,
+	"admin":    roleAdmin,
+}
+
+const tokenHashPrefix = "sha256:"
+
+// authConfig lists the tokens allowed to use the API. With none configured
+// there is no authentication and every caller is an admin
+type authConfig struct {
+	Tokens []tokenConfig `yaml:"tokens"`
+}
+
+// tokenConfig holds a hash of the token rather than the token itself, see
+// hashToken
+type tokenConfig struct {
+	Name string `yaml:"name"`
+	Role string `yaml:"role"`
+	Hash string `yaml:"hash,omitempty"`
+}
+
+// identity is who made a request, as far as we know
+type identity struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	role int
+}
+
+// Authenticate works out who is calling from the bearer token. Browsers can't
+// add headers to <img>, EventSource or websocket requests, so the token can
+// also be passed as ?access_token=
+func Authenticate(cfg authConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(cfg.Tokens) == 0 {
+			c.Set(identityKey, identity{Name: "anonymous", Role: "admin", role: roleAdmin})
+			c.Next()
+			return
+		}
+
+		token := c.Query("access_token")
+
+		if header := c.GetHeader("Authorization"); header != "" {
+			scheme, value, _ := strings.Cut(header, " ")
+
+			if !strings.EqualFold(scheme, "Bearer") {
+				c.Header("WWW-Authenticate", "Bearer")
+				c.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse{Error: "authorization must be a bearer token"})
+				return
+			}
+
+			token = strings.TrimSpace(value)
+		}
+
+		if token == "" {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse{Error: "an API token is required"})
+			return
+		}
+
+		id, ok := cfg.lookup(token)
+
+		if !ok {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse{Error: "API token is not valid"})
+			return
+		}
+
+		c.Set(identityKey, id)
+		c.Next()
+	}
+}
+
+// RequireRole rejects callers whose role is below the one given
+func RequireRole(role int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if id := getIdentity(c); id.role < role {
+			c.AbortWithStatusJSON(http.StatusForbidden, errorResponse{Error: fmt.Sprintf("%s role cannot do this", id.Role)})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func getIdentity(c *gin.Context) identity {
+	if id, ok := c.Get(identityKey); ok {
+		return id.(identity)
+	}
+
+	return identity{}
+}
+
+// getConfig returns the configuration the server is running with, minus the
+// token hashes
+func getConfig(c *gin.Context) {
+	cfg := config
+	cfg.Auth.Tokens = nil
+
+	for _, t := range config.Auth.Tokens {
+		cfg.Auth.Tokens = append(cfg.Auth.Tokens, tokenConfig{Name: t.Name, Role: t.Role})
+	}
+
+	c.YAML(http.StatusOK, cfg)
+}
+
+// lookup checks every token so the time taken doesn't give away which (if
+// any) matched
+func (cfg authConfig) lookup(token string) (identity, bool) {
+	hash := hashToken(token)
+	var found *tokenConfig
+
+	for i := range cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(strings.ToLower(cfg.Tokens[i].Hash))) == 1 {
+			found = &cfg.Tokens[i]
+		}
+	}
+
+	if found == nil {
+		return identity{}, false
+	}
+
+	role := strings.ToLower(found.Role)
+
+	return identity{Name: found.Name, Role: role, role: roleNames[role]}, true
+}
+
+func (cfg authConfig) validate() []string {
+	var problems []string
+	names := map[string]bool{}
+
+	for i, t := range cfg.Tokens {
+		if t.Name == "" {
+			problems = append(problems, fmt.Sprintf("token %d has no name", i+1))
+		} else if names[t.Name] {
+			problems = append(problems, fmt.Sprintf("token name %q is used more than once", t.Name))
+		}
+
+		names[t.Name] = true
+
+		if _, ok := roleNames[strings.ToLower(t.Role)]; !ok {
+			problems = append(problems, fmt.Sprintf("token %q has unknown role %q, expected viewer, operator or admin", t.Name, t.Role))
+		}
+
+		if !validTokenHash(t.Hash) {
+			problems = append(problems, fmt.Sprintf("token %q hash should be sha256: followed by 64 hex digits, see hash-token", t.Name))
+		}
+	}
+
+	return problems
+}
+
+// hashToken is how tokens are stored in the configuration. The tokens are
+// long random strings rather than passwords, so a plain hash is enough
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return tokenHashPrefix + hex.EncodeToString(sum[:])
+}
+
+func validTokenHash(hash string) bool {
+	digits, found := strings.CutPrefix(strings.ToLower(hash), tokenHashPrefix)
+
+	if !found || len(digits) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(digits)
+
+	return err == nil
+}
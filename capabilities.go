@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// capabilities is everything a planning tool needs to know about what the
+// camera can do, gathered from DeviceInfo and CameraInfo
+type capabilities struct {
+	Device   deviceMeta           `json:"device"`
+	Exposure exposureCapabilities `json:"exposure"`
+	Sensor   sensorCapabilities   `json:"sensor"`
+	// ImageModes and CropModes are the values this server accepts (see
+	// imageModeFromString and cropModeAsString), the DLL doesn't say which
+	// of them a particular body supports. CropMode is the one in use
+	ImageModes []string `json:"imageModes"`
+	CropModes  []string `json:"cropModes"`
+	CropMode   string   `json:"cropMode"`
+	Flags      uint32   `json:"flags"`
+	// FromDatabase is set when some values came from the model database
+	// because the camera reported zeros, DatabaseFields lists which
+	FromDatabase   bool     `json:"fromDatabase"`
+	DatabaseFields []string `json:"databaseFields,omitempty"`
+}
+
+// exposureCapabilities are in seconds
+type exposureCapabilities struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Step float64 `json:"step"`
+}
+
+type sensorCapabilities struct {
+	Name          string  `json:"name"`
+	Width         uint32  `json:"width"`
+	Height        uint32  `json:"height"`
+	CroppedWidth  uint32  `json:"croppedWidth"`
+	CroppedHeight uint32  `json:"croppedHeight"`
+	PreviewWidth  uint32  `json:"previewWidth"`
+	PreviewHeight uint32  `json:"previewHeight"`
+	PixelWidth    float64 `json:"pixelWidth"`
+	PixelHeight   float64 `json:"pixelHeight"`
+	BitsPerPixel  uint32  `json:"bitsPerPixel"`
+	// WidthMM and HeightMM are the physical size of the full sensor
+	WidthMM      float64 `json:"widthMM"`
+	HeightMM     float64 `json:"heightMM"`
+	BayerPattern string  `json:"bayerPattern"`
+	BayerXOffset uint32  `json:"bayerXOffset"`
+	BayerYOffset uint32  `json:"bayerYOffset"`
+}
+
+func getCapabilities(c *gin.Context) {
+	hCamera := getCameraHandleFromPath(c)
+
+	dInfo, cInfo, err := fetchCameraInfo(c.Request.Context(), hCamera)
+
+	if err != nil {
+		abortWithCameraError(c, err)
+		return
+	}
+
+	filled := fillFromModelDatabase(&dInfo, &cInfo)
+
+	result := capabilities{
+		Device: deviceMeta{
+			Manufacturer:  dInfo.Manufacturer,
+			Model:         dInfo.Model,
+			SerialNumber:  dInfo.SerialNumber,
+			DeviceVersion: dInfo.DeviceVersion,
+			SensorName:    dInfo.SensorName,
+			DeviceName:    dInfo.DeviceName,
+		},
+		Exposure: exposureCapabilities{
+			Min:  dInfo.ExposureTimeMin,
+			Max:  dInfo.ExposureTimeMax,
+			Step: dInfo.ExposureTimeStep,
+		},
+		Sensor: sensorCapabilities{
+			Name:          dInfo.SensorName,
+			Width:         cInfo.SensorImageWidth,
+			Height:        cInfo.SensorImageHeight,
+			CroppedWidth:  cInfo.CroppedImageWidth,
+			CroppedHeight: cInfo.CroppedImageHeight,
+			PreviewWidth:  cInfo.PreviewWidth,
+			PreviewHeight: cInfo.PreviewHeight,
+			PixelWidth:    cInfo.PixelWidth,
+			PixelHeight:   cInfo.PixelHeight,
+			BitsPerPixel:  dInfo.BitsPerPixel,
+			WidthMM:       sensorSizeMM(cInfo.SensorImageWidth, cInfo.PixelWidth),
+			HeightMM:      sensorSizeMM(cInfo.SensorImageHeight, cInfo.PixelHeight),
+			BayerPattern:  bayerPattern(cInfo.BayerXOffset, cInfo.BayerYOffset),
+			BayerXOffset:  cInfo.BayerXOffset,
+			BayerYOffset:  cInfo.BayerYOffset,
+		},
+		ImageModes:     []string{"jpeg", "raw", "rgb"},
+		CropModes:      []string{cropModeAsString(0), cropModeAsString(1), cropModeAsString(2)},
+		CropMode:       cropModeAsString(dInfo.CropMode),
+		Flags:          cInfo.Flags,
+		FromDatabase:   len(filled) > 0,
+		DatabaseFields: filled,
+	}
+
+	c.IndentedJSON(http.StatusOK, result)
+}
+
+// bayerPattern names the colour filter layout, the offsets say where the
+// first red pixel sits relative to the top left of the image
+func bayerPattern(xOffset uint32, yOffset uint32) string {
+	switch {
+	case xOffset%2 == 0 && yOffset%2 == 0:
+		return "RGGB"
+	case xOffset%2 == 1 && yOffset%2 == 0:
+		return "GRBG"
+	case xOffset%2 == 0 && yOffset%2 == 1:
+		return "GBRG"
+	default:
+		return "BGGR"
+	}
+}
+
+// sensorSizeMM works out a physical dimension from the pixel count and the
+// pixel size, which the driver reports in microns
+func sensorSizeMM(pixels uint32, pixelSize float64) float64 {
+	return math.Round(float64(pixels)*pixelSize) / 1000
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"Sony/Web/winstruct"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Image modes understood by StartCapture/GetPreviewImage
+const (
+	imageModeRGB  = 1
+	imageModeRAW  = 2
+	imageModeJPEG = 3
+)
+
+// Status flags returned by GetCaptureStatus
+const (
+	captureStatusCreated   = 0x0000
+	captureStatusCapturing = 0x0001
+	captureStatusReading   = 0x0002
+	captureStatusCancelled = 0x2000
+	captureStatusFailed    = 0x4000
+	captureStatusComplete  = 0x8000
+)
+
+// States a capture moves through, as reported to clients
+const (
+	captureStateExposing    = "exposing"
+	captureStateDownloading = "downloading"
+	captureStateComplete    = "complete"
+	captureStateFailed      = "failed"
+	captureStateAborted     = "aborted"
+	// captureStateAborting is while the camera is being asked to cancel
+	captureStateAborting = "aborting"
+	// captureStateCancelFailed means the camera didn't take the cancel and
+	// may still be exposing, so the capture carries on as far as we know. The
+	// monitor is still running and moves it on like any other capture
+	captureStateCancelFailed = "cancel_failed"
+)
+
+// errCaptureDownloading is returned for an abort that comes too late, the
+// exposure has finished and the image is on its way
+var errCaptureDownloading = errors.New("capture has finished exposing and is downloading, it can't be aborted")
+
+const (
+	capturePollInterval = 100 * time.Millisecond
+	// captureDownloadTime is how long we allow on top of the exposure itself
+	// for the camera to write and hand over the image
+	captureDownloadTime = 60 * time.Second
+	// maxRetainedCaptures limits how many finished captures (and their images)
+	// are kept in memory per camera
+	maxRetainedCaptures = 10
+)
+
+type captureRequest struct {
+	Duration  float64 `json:"duration"`
+	ImageMode string  `json:"imageMode"`
+}
+
+// captureImage is the image metadata, without the (possibly huge) pixel data
+type captureImage struct {
+	Size      uint    `json:"size"`
+	Status    uint    `json:"status"`
+	ImageMode uint    `json:"imageMode"`
+	Width     uint    `json:"width"`
+	Height    uint    `json:"height"`
+	Flags     uint    `json:"flags"`
+	MetaSize  uint    `json:"metaSize"`
+	Meta      []byte  `json:"meta"`
+	Duration  float64 `json:"duration"`
+}
+
+type capture struct {
+	ID        string        `json:"id"`
+	Handle    uint64        `json:"handle"`
+	Duration  float64       `json:"duration"`
+	ImageMode string        `json:"imageMode"`
+	State     string        `json:"state"`
+	Started   time.Time     `json:"started"`
+	Finished  *time.Time    `json:"finished,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	Image     *captureImage `json:"imageInfo,omitempty"`
+
+	image *imageInfo
+}
+
+var (
+	capturesLock  sync.Mutex
+	captures      = map[string]*capture{}
+	lastCaptureId uint64
+)
+
+func startCapture(c *gin.Context) {
+	hCamera := getCameraHandleFromPath(c)
+
+	in := captureRequest{ImageMode: "jpeg"}
+
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	cp, status, err := beginCapture(c.Request.Context(), hCamera, in)
+
+	if cp == nil {
+		c.IndentedJSON(status, errorResponse{Error: err.Error()})
+		return
+	}
+
+	c.IndentedJSON(status, cp.snapshot())
+}
+
+// beginCapture validates the request and starts the exposure. It returns the
+// http status that best describes the outcome, and the capture if one was
+// created (a capture the camera refused is still returned, in failed state)
+func beginCapture(ctx context.Context, hCamera uintptr, in captureRequest) (*capture, int, error) {
+	if in.ImageMode == "" {
+		in.ImageMode = "jpeg"
+	}
+
+	mode, err := imageModeFromString(in.ImageMode)
+
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if in.Duration < 0 {
+		return nil, http.StatusBadRequest, errors.New("duration cannot be negative")
+	}
+
+	capturesLock.Lock()
+
+	// The camera can only take one picture at a time
+	for _, cp := range captures {
+		if cp.Handle == uint64(hCamera) && !cp.finished() {
+			capturesLock.Unlock()
+			return nil, http.StatusConflict, fmt.Errorf("capture %s is already in progress", cp.ID)
+		}
+	}
+
+	lastCaptureId++
+	cp := &capture{
+		ID:        strconv.FormatUint(lastCaptureId, 10),
+		Handle:    uint64(hCamera),
+		Duration:  in.Duration,
+		ImageMode: in.ImageMode,
+		State:     captureStateExposing,
+		Started:   time.Now(),
+	}
+	captures[cp.ID] = cp
+	pruneCaptures(cp.Handle)
+
+	capturesLock.Unlock()
+
+	info := imageInfo{ImageMode: mode, Duration: in.Duration}
+	buffer := winstruct.Marshal(&info)
+	hr, err := callCamera(ctx, hCamera, procStartCapture, getPointerToSlice(buffer.Bytes()))
+
+	if err != nil {
+		cp.fail(err.Error())
+		return cp, cameraErrorStatus(err), err
+	}
+
+	if hr != 0 {
+		err = fmt.Errorf("camera refused to start capture (error %d)", hr)
+		cp.fail(err.Error())
+		return cp, http.StatusBadGateway, err
+	}
+
+	// The capture carries on after the request that started it has gone
+	go cp.monitor(context.Background(), hCamera)
+
+	return cp, http.StatusAccepted, nil
+}
+
+func getCaptures(c *gin.Context) {
+	hCamera := getCameraHandleFromPath(c)
+
+	c.IndentedJSON(http.StatusOK, capturesForCamera(hCamera))
+}
+
+// capturesForCamera returns a snapshot of every capture known for a camera,
+// oldest first
+func capturesForCamera(hCamera uintptr) []capture {
+	var result []capture
+
+	capturesLock.Lock()
+	for _, cp := range captures {
+		if cp.Handle == uint64(hCamera) {
+			result = append(result, *cp)
+		}
+	}
+	capturesLock.Unlock()
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Started.Before(result[j].Started) })
+
+	return result
+}
+
+func getCapture(c *gin.Context) {
+	cp := getCaptureFromPath(c)
+
+	if cp == nil {
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, cp.snapshot())
+}
+
+// getCaptureImage returns the image bytes as-is, with the interesting parts
+// of the imageInfo in headers
+func getCaptureImage(c *gin.Context) {
+	cp := getCaptureFromPath(c)
+
+	if cp == nil {
+		return
+	}
+
+	capturesLock.Lock()
+	state := cp.State
+	image := cp.image
+	capturesLock.Unlock()
+
+	// Aborted captures only have an image if the partial result was kept
+	if (state != captureStateComplete && state != captureStateAborted) || image == nil {
+		c.IndentedJSON(http.StatusConflict, errorResponse{Error: fmt.Sprintf("capture %s is %s, no image available", cp.ID, state)})
+		return
+	}
+
+	contentType := "application/octet-stream"
+	extension := "raw"
+
+	if image.ImageMode == imageModeJPEG {
+		contentType = "image/jpeg"
+		extension = "jpg"
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"capture-%s.%s\"", cp.ID, extension))
+	setImageHeaders(c, image)
+	c.Data(http.StatusOK, contentType, image.Data)
+
+	bytesSent.WithLabelValues("capture").Add(float64(len(image.Data)))
+}
+
+// deleteCapture aborts a capture that is still in progress, or forgets a
+// finished one. Pass keepPartial=true to keep whatever image the camera
+// hands back when cancelling
+func deleteCapture(c *gin.Context) {
+	hCamera := getCameraHandleFromPath(c)
+	cp := getCaptureFromPath(c)
+
+	if cp == nil {
+		return
+	}
+
+	capturesLock.Lock()
+	finished := cp.finished()
+
+	if finished {
+		delete(captures, cp.ID)
+	}
+	capturesLock.Unlock()
+
+	if finished {
+		c.IndentedJSON(http.StatusOK, emptyResponse{})
+		return
+	}
+
+	keepPartial, _ := strconv.ParseBool(c.Query("keepPartial"))
+
+	if err := cp.abort(c.Request.Context(), hCamera, keepPartial); errors.Is(err, errCaptureDownloading) {
+		c.IndentedJSON(http.StatusConflict, errorResponse{Error: err.Error()})
+		return
+	} else if err != nil {
+		c.IndentedJSON(cameraErrorStatus(err), errorResponse{Error: err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, cp.snapshot())
+}
+
+// abortCaptures cancels every in-progress capture on a camera, used when the
+// camera is being closed. It returns how many captures there were
+func abortCaptures(ctx context.Context, hCamera uintptr) int {
+	var active []*capture
+
+	capturesLock.Lock()
+	for _, cp := range captures {
+		if cp.Handle == uint64(hCamera) && !cp.finished() {
+			active = append(active, cp)
+		}
+	}
+	capturesLock.Unlock()
+
+	for _, cp := range active {
+		_ = cp.abort(ctx, hCamera, false)
+	}
+
+	return len(active)
+}
+
+// forgetCaptures drops every capture (and its image) for a camera that has
+// been closed
+func forgetCaptures(hCamera uintptr) {
+	capturesLock.Lock()
+	defer capturesLock.Unlock()
+
+	for id, cp := range captures {
+		if cp.Handle == uint64(hCamera) {
+			delete(captures, id)
+		}
+	}
+}
+
+func getCaptureFromPath(c *gin.Context) *capture {
+	hCamera := getCameraHandleFromPath(c)
+
+	capturesLock.Lock()
+	cp, ok := captures[c.Param("id")]
+	capturesLock.Unlock()
+
+	if !ok || cp.Handle != uint64(hCamera) {
+		c.IndentedJSON(http.StatusNotFound, errorResponse{Error: fmt.Sprintf("no capture with id %s", c.Param("id"))})
+		return nil
+	}
+
+	return cp
+}
+
+// monitor polls the camera until the capture finishes, then fetches the image
+func (cp *capture) monitor(ctx context.Context, hCamera uintptr) {
+	deadline := time.Now().Add(time.Duration(cp.Duration*float64(time.Second)) + captureDownloadTime)
+
+	for {
+		status, err := callCamera(ctx, hCamera, procGetCaptureStatus)
+
+		if errors.Is(err, errCameraClosed) {
+			cp.fail(err.Error())
+			return
+		}
+
+		// Someone may have aborted the capture while we were waiting
+		capturesLock.Lock()
+		state := cp.State
+		capturesLock.Unlock()
+
+		if state == captureStateAborted {
+			return
+		}
+
+		// Wait to see whether the cancel goes through. CancelCapture has its
+		// own timeout, so this doesn't go on forever
+		if state == captureStateAborting {
+			time.Sleep(capturePollInterval)
+			continue
+		}
+
+		// A slow or unhealthy camera gets until the deadline to come back
+		switch {
+		case err != nil:
+		case status&captureStatusComplete != 0:
+			cp.setState(captureStateDownloading)
+			cp.download(ctx, hCamera)
+			return
+		case status&(captureStatusFailed|captureStatusCancelled) != 0:
+			cp.fail(fmt.Sprintf("camera reported capture failure (status x%04x)", status))
+			return
+		case status&captureStatusReading != 0:
+			cp.setState(captureStateDownloading)
+		}
+
+		if time.Now().After(deadline) {
+			cp.fail("timed out waiting for the camera to finish the capture")
+			return
+		}
+
+		time.Sleep(capturePollInterval)
+	}
+}
+
+func (cp *capture) download(ctx context.Context, hCamera uintptr) {
+	info := imageInfo{}
+	buffer := winstruct.Marshal(&info)
+	hr, err := callCamera(ctx, hCamera, procGetImage, getPointerToSlice(buffer.Bytes()))
+
+	if err != nil {
+		cp.fail(fmt.Sprintf("unable to read image from camera: %s", err))
+		return
+	}
+
+	if hr != 0 {
+		cp.fail(fmt.Sprintf("unable to read image from camera (error %d)", hr))
+		return
+	}
+
+	winstruct.Unmarshal(buffer, &info)
+
+	capturesLock.Lock()
+	defer capturesLock.Unlock()
+
+	// An abort that is still going through lost the race, the exposure
+	// finished so the image is kept rather than thrown away
+	if cp.State == captureStateAborted {
+		return
+	}
+
+	now := time.Now()
+	cp.image = &info
+	cp.Image = imageMetaFromInfo(info)
+	cp.State = captureStateComplete
+	cp.Finished = &now
+
+	captureOutcomes.WithLabelValues(captureStateComplete).Inc()
+}
+
+// abort asks the camera to cancel the exposure. The capture is only marked
+// aborted once the camera has taken the cancel, until then it is aborting so
+// the monitor holds off, and if the cancel fails it is cancel_failed, which
+// still stops another capture being started
+func (cp *capture) abort(ctx context.Context, hCamera uintptr, keepPartial bool) error {
+	capturesLock.Lock()
+
+	if cp.finished() || cp.State == captureStateAborting {
+		capturesLock.Unlock()
+		return nil
+	}
+
+	if cp.State == captureStateDownloading {
+		capturesLock.Unlock()
+		return errCaptureDownloading
+	}
+
+	cp.State = captureStateAborting
+	capturesLock.Unlock()
+
+	info := imageInfo{}
+	buffer := winstruct.Marshal(&info)
+	hr, err := callCamera(ctx, hCamera, procCancelCapture, getPointerToSlice(buffer.Bytes()))
+
+	if err == nil && hr != 0 {
+		err = fmt.Errorf("camera did not acknowledge cancel (error %d)", hr)
+	}
+
+	capturesLock.Lock()
+	defer capturesLock.Unlock()
+
+	// The monitor may have finished the capture meanwhile, by downloading an
+	// exposure that had already completed or failing it because the camera
+	// was closed. Either way it is settled and there is nothing to report
+	if cp.State != captureStateAborting {
+		return nil
+	}
+
+	if err != nil {
+		cp.State = captureStateCancelFailed
+		cp.Error = err.Error()
+
+		return err
+	}
+
+	now := time.Now()
+	cp.State = captureStateAborted
+	cp.Error = ""
+	cp.Finished = &now
+
+	if keepPartial {
+		winstruct.Unmarshal(buffer, &info)
+
+		if info.Size > 0 {
+			cp.image = &info
+			cp.Image = imageMetaFromInfo(info)
+		}
+	}
+
+	captureOutcomes.WithLabelValues(captureStateAborted).Inc()
+
+	return nil
+}
+
+func (cp *capture) setState(state string) {
+	capturesLock.Lock()
+	if !cp.finished() && cp.State != captureStateAborting {
+		cp.State = state
+	}
+	capturesLock.Unlock()
+}
+
+func (cp *capture) fail(reason string) {
+	capturesLock.Lock()
+	defer capturesLock.Unlock()
+
+	// A capture only finishes once, whichever way it goes
+	if cp.finished() {
+		return
+	}
+
+	now := time.Now()
+	cp.State = captureStateFailed
+	cp.Error = reason
+	cp.Finished = &now
+
+	captureOutcomes.WithLabelValues(captureStateFailed).Inc()
+}
+
+// finished must be called with capturesLock held
+func (cp *capture) finished() bool {
+	return cp.State == captureStateComplete || cp.State == captureStateFailed || cp.State == captureStateAborted
+}
+
+func (cp *capture) snapshot() capture {
+	capturesLock.Lock()
+	defer capturesLock.Unlock()
+
+	return *cp
+}
+
+// pruneCaptures drops the oldest finished captures for a camera so we don't
+// hold on to every image ever taken. Must be called with capturesLock held
+func pruneCaptures(handle uint64) {
+	var finished []*capture
+
+	for _, cp := range captures {
+		if cp.Handle == handle && cp.finished() {
+			finished = append(finished, cp)
+		}
+	}
+
+	if len(finished) <= maxRetainedCaptures {
+		return
+	}
+
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Started.Before(finished[j].Started) })
+
+	for _, cp := range finished[:len(finished)-maxRetainedCaptures] {
+		delete(captures, cp.ID)
+	}
+}
+
+func imageMetaFromInfo(info imageInfo) *captureImage {
+	return &captureImage{
+		Size:      info.Size,
+		Status:    info.Status,
+		ImageMode: info.ImageMode,
+		Width:     info.Width,
+		Height:    info.Height,
+		Flags:     info.Flags,
+		MetaSize:  info.MetaSize,
+		Meta:      info.Meta,
+		Duration:  info.Duration,
+	}
+}
+
+func imageModeFromString(mode string) (uint, error) {
+	switch mode {
+	case "jpeg", "jpg":
+		return imageModeJPEG, nil
+	case "raw":
+		return imageModeRAW, nil
+	case "rgb":
+		return imageModeRGB, nil
+	default:
+		return 0, fmt.Errorf("unknown image mode %q, expected jpeg, raw or rgb", mode)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// serverConfig is everything that can be set from the config file,
+// environment or command line, in that order of precedence (lowest first)
+type serverConfig struct {
+	// Listen is one or more addresses to serve on
+	Listen []string `yaml:"listen"`
+	// UnixSocket is the path of a unix domain socket to serve on as well
+	UnixSocket string         `yaml:"unixSocket"`
+	TLS        tlsSettings    `yaml:"tls"`
+	DLLPath    string         `yaml:"dllPath"`
+	CORS       corsConfig     `yaml:"cors"`
+	Preview    previewConfig  `yaml:"preview"`
+	Polling    pollingConfig  `yaml:"polling"`
+	Timeouts   timeoutsConfig `yaml:"timeouts"`
+	LogLevel   string         `yaml:"logLevel"`
+	Auth       authConfig     `yaml:"auth"`
+	// ShutdownTimeout is how long requests get to finish when stopping,
+	// before their connections are closed
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+}
+
+type previewConfig struct {
+	// ImageMode is jpeg, rgb or raw
+	ImageMode string `yaml:"imageMode"`
+}
+
+type pollingConfig struct {
+	Devices      time.Duration `yaml:"devices"`
+	CameraEvents time.Duration `yaml:"cameraEvents"`
+}
+
+type timeoutsConfig struct {
+	Default    time.Duration            `yaml:"default"`
+	Operations map[string]time.Duration `yaml:"operations"`
+}
+
+// config is the configuration the server was started with
+var config = defaultConfig()
+
+func defaultConfig() serverConfig {
+	operations := map[string]time.Duration{}
+
+	for name, timeout := range operationTimeouts {
+		operations[name] = timeout
+	}
+
+	return serverConfig{
+		Listen:   []string{"localhost:8080"},
+		DLLPath:  "SonyMTPCamera.dll",
+		CORS:     defaultCORSConfig(),
+		Preview:  previewConfig{ImageMode: "jpeg"},
+		Polling:  pollingConfig{Devices: 2 * time.Second, CameraEvents: time.Second},
+		Timeouts: timeoutsConfig{Default: defaultOperationTimeout, Operations: operations},
+		LogLevel: "info",
+
+		ShutdownTimeout: 15 * time.Second,
+	}
+}
+
+// loadConfig builds the configuration from the file (if there is one), then
+// SONY_* environment variables, then the command line. It returns true if the
+// configuration should be printed rather than the server started
+func loadConfig(args []string) (serverConfig, bool, error) {
+	cfg := defaultConfig()
+
+	flags := flag.NewFlagSet("SonyCamGoAPI", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("SONY_CONFIG"), "YAML or JSON config file")
+	printConfig := flags.Bool("print-config", false, "print the configuration and exit")
+	listen := flags.String("listen", "", "comma separated addresses to listen on")
+	dllPath := flags.String("dll", "", "path to SonyMTPCamera.dll")
+	corsOrigins := flags.String("cors-origins", "", "comma separated origins allowed to make cross-origin requests")
+	previewMode := flags.String("preview-image-mode", "", "preview image mode: jpeg, rgb or raw")
+	devicePoll := flags.Duration("device-poll-interval", 0, "how often to check for cameras being plugged in or removed")
+	eventPoll := flags.Duration("event-poll-interval", 0, "how often watched cameras are checked for changes")
+	timeout := flags.Duration("timeout", 0, "timeout for DLL calls without their own")
+	operations := flags.String("operation-timeouts", "", "per-call timeouts, e.g. GetImage=3m,GetPreviewImage=2s")
+	logLevel := flags.String("log-level", "", "debug, info, warn or error")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 0, "how long requests get to finish when stopping")
+	unixSocket := flags.String("unix-socket", "", "path of a unix domain socket to listen on as well")
+	tlsCert := flags.String("tls-cert", "", "certificate file, turns on HTTPS")
+	tlsKey := flags.String("tls-key", "", "private key file, turns on HTTPS")
+	tlsSelfSigned := flags.Bool("tls-self-signed", false, "turn on HTTPS, generating a self-signed certificate if there isn't one")
+
+	if err := flags.Parse(args); err != nil {
+		return cfg, false, err
+	}
+
+	if *configPath != "" {
+		if err := readConfigFile(*configPath, &cfg); err != nil {
+			return cfg, false, err
+		}
+	}
+
+	if err := applyConfigEnv(&cfg); err != nil {
+		return cfg, false, err
+	}
+
+	var err error
+
+	// Only flags that were actually given override the file and environment
+	flags.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+
+		switch f.Name {
+		case "listen":
+			cfg.Listen = splitList(*listen)
+		case "dll":
+			cfg.DLLPath = *dllPath
+		case "cors-origins":
+			cfg.CORS.AllowedOrigins = splitList(*corsOrigins)
+		case "preview-image-mode":
+			cfg.Preview.ImageMode = *previewMode
+		case "device-poll-interval":
+			cfg.Polling.Devices = *devicePoll
+		case "event-poll-interval":
+			cfg.Polling.CameraEvents = *eventPoll
+		case "timeout":
+			cfg.Timeouts.Default = *timeout
+		case "operation-timeouts":
+			err = parseOperationTimeouts(*operations, &cfg.Timeouts)
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = *shutdownTimeout
+		case "unix-socket":
+			cfg.UnixSocket = *unixSocket
+		case "tls-cert":
+			cfg.TLS.CertFile = *tlsCert
+			cfg.TLS.Enabled = true
+		case "tls-key":
+			cfg.TLS.KeyFile = *tlsKey
+			cfg.TLS.Enabled = true
+		case "tls-self-signed":
+			cfg.TLS.SelfSigned = *tlsSelfSigned
+			cfg.TLS.Enabled = cfg.TLS.Enabled || *tlsSelfSigned
+		}
+	})
+
+	if err != nil {
+		return cfg, false, err
+	}
+
+	return cfg, *printConfig, cfg.validate()
+}
+
+// readConfigFile reads a YAML file, which covers JSON too
+func readConfigFile(path string, cfg *serverConfig) error {
+	b, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return fmt.Errorf("unable to read %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func applyConfigEnv(cfg *serverConfig) error {
+	if v, ok := os.LookupEnv("SONY_LISTEN"); ok {
+		cfg.Listen = splitList(v)
+	}
+
+	if v, ok := os.LookupEnv("SONY_DLL_PATH"); ok {
+		cfg.DLLPath = v
+	}
+
+	if v, ok := os.LookupEnv("SONY_CORS_ORIGINS"); ok {
+		cfg.CORS.AllowedOrigins = splitList(v)
+	}
+
+	if v, ok := os.LookupEnv("SONY_PREVIEW_IMAGE_MODE"); ok {
+		cfg.Preview.ImageMode = v
+	}
+
+	if v, ok := os.LookupEnv("SONY_LOG_LEVEL"); ok {
+		cfg.LogLevel = v
+	}
+
+	if v, ok := os.LookupEnv("SONY_UNIX_SOCKET"); ok {
+		cfg.UnixSocket = v
+	}
+
+	if v, ok := os.LookupEnv("SONY_TLS_CERT"); ok {
+		cfg.TLS.CertFile = v
+		cfg.TLS.Enabled = true
+	}
+
+	if v, ok := os.LookupEnv("SONY_TLS_KEY"); ok {
+		cfg.TLS.KeyFile = v
+		cfg.TLS.Enabled = true
+	}
+
+	durations := []struct {
+		name   string
+		target *time.Duration
+	}{
+		{"SONY_DEVICE_POLL_INTERVAL", &cfg.Polling.Devices},
+		{"SONY_EVENT_POLL_INTERVAL", &cfg.Polling.CameraEvents},
+		{"SONY_TIMEOUT", &cfg.Timeouts.Default},
+		{"SONY_SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout},
+	}
+
+	for _, d := range durations {
+		if v, ok := os.LookupEnv(d.name); ok {
+			parsed, err := time.ParseDuration(v)
+
+			if err != nil {
+				return fmt.Errorf("%s: %w", d.name, err)
+			}
+
+			*d.target = parsed
+		}
+	}
+
+	if v, ok := os.LookupEnv("SONY_OPERATION_TIMEOUTS"); ok {
+		if err := parseOperationTimeouts(v, &cfg.Timeouts); err != nil {
+			return fmt.Errorf("SONY_OPERATION_TIMEOUTS: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (cfg serverConfig) validate() error {
+	var problems []string
+
+	if len(cfg.Listen) == 0 && cfg.UnixSocket == "" {
+		problems = append(problems, "at least one listen address or a unix socket is required")
+	}
+
+	if cfg.TLS.Enabled && (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		problems = append(problems, "tls needs both certFile and keyFile, or neither to use a generated certificate")
+	}
+
+	if cfg.TLS.Enabled && cfg.TLS.CertFile == "" && !cfg.TLS.SelfSigned {
+		problems = append(problems, "tls needs certFile and keyFile unless selfSigned is set")
+	}
+
+	for _, addr := range cfg.Listen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			problems = append(problems, fmt.Sprintf("listen address %q: %s", addr, err))
+		}
+	}
+
+	problems = append(problems, cfg.CORS.validate()...)
+
+	if cfg.DLLPath == "" {
+		problems = append(problems, "dllPath is required")
+	}
+
+	if _, err := imageModeFromString(cfg.Preview.ImageMode); err != nil {
+		problems = append(problems, "preview: "+err.Error())
+	}
+
+	if cfg.Polling.Devices <= 0 || cfg.Polling.CameraEvents <= 0 {
+		problems = append(problems, "polling intervals must be greater than zero")
+	}
+
+	if cfg.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdownTimeout must be greater than zero")
+	}
+
+	if cfg.Timeouts.Default <= 0 {
+		problems = append(problems, "default timeout must be greater than zero")
+	}
+
+	for name, timeout := range cfg.Timeouts.Operations {
+		if timeout <= 0 {
+			problems = append(problems, fmt.Sprintf("timeout for %s must be greater than zero", name))
+		}
+	}
+
+	if _, ok := logLevels[strings.ToLower(cfg.LogLevel)]; !ok {
+		problems = append(problems, fmt.Sprintf("unknown log level %q, expected debug, info, warn or error", cfg.LogLevel))
+	}
+
+	problems = append(problems, cfg.Auth.validate()...)
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// apply pushes the configuration out to the parts of the server that use it.
+// It must be called before anything touches the DLL
+func (cfg serverConfig) apply() {
+	cameraDLL.Name = cfg.DLLPath
+	previewImageMode, _ = imageModeFromString(cfg.Preview.ImageMode)
+	deviceWatchInterval = cfg.Polling.Devices
+	cameraEventPollInterval = cfg.Polling.CameraEvents
+	defaultOperationTimeout = cfg.Timeouts.Default
+	operationTimeouts = cfg.Timeouts.Operations
+	logLevel = logLevels[strings.ToLower(cfg.LogLevel)]
+	config = cfg
+}
+
+func splitList(list string) []string {
+	var result []string
+
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// corsConfig is the cross-origin policy. Origins not in AllowedOrigins get no
+// CORS headers at all, so browsers block them
+type corsConfig struct {
+	// AllowedOrigins of "*" allows any origin, which can't be combined with
+	// AllowCredentials. An origin ending ":*" allows any port
+	AllowedOrigins   []string `yaml:"allowedOrigins"`
+	AllowCredentials bool     `yaml:"allowCredentials"`
+	AllowedHeaders   []string `yaml:"allowedHeaders"`
+	// ExposedHeaders can be read by scripts, such as the preview frame details
+	ExposedHeaders []string `yaml:"exposedHeaders"`
+	// AllowedMethods is the most any route allows, each route only offers
+	// the methods it actually has
+	AllowedMethods []string `yaml:"allowedMethods"`
+	// RouteMethods narrows the methods for particular routes, keyed by the
+	// route as registered, e.g. "/cameras/:handle/exposure": [GET]
+	RouteMethods map[string][]string `yaml:"routeMethods"`
+	MaxAge       time.Duration       `yaml:"maxAge"`
+}
+
+func defaultCORSConfig() corsConfig {
+	return corsConfig{
+		// Pages served from this machine, on any port
+		AllowedOrigins: []string{"http://localhost:*", "https://localhost:*", "http://127.0.0.1:*", "https://127.0.0.1:*", "http://[::1]:*", "https://[::1]:*"},
+		AllowedHeaders: []string{"Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization", "Accept", "Origin", "Cache-Control", "X-Requested-With", "If-None-Match", leaseHeader},
+		ExposedHeaders: []string{
+			"ETag",
+			"X-Property-Version",
+			"X-Frame-Sequence", "X-Frame-Timestamp",
+			"X-Image-Width", "X-Image-Height", "X-Image-Status", "X-Image-Duration",
+		},
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		MaxAge:         10 * time.Minute,
+	}
+}
+
+// CORSMiddleware applies the configured policy, answering preflight requests
+// with the methods registered for the requested route
+func CORSMiddleware(router *gin.Engine, cfg corsConfig) gin.HandlerFunc {
+	var (
+		routesOnce sync.Once
+		routes     map[string][]string
+	)
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+
+		// Not a cross-origin request, nothing to add
+		if origin == "" {
+			if preflight {
+				c.AbortWithStatus(http.StatusNoContent)
+				return
+			}
+
+			c.Next()
+			return
+		}
+
+		allowOrigin, ok := cfg.allowOrigin(origin)
+
+		if !ok {
+			if preflight {
+				c.AbortWithStatusJSON(http.StatusForbidden, errorResponse{Error: "origin not allowed"})
+				return
+			}
+
+			c.Next()
+			return
+		}
+
+		header := c.Writer.Header()
+		header.Set("Access-Control-Allow-Origin", allowOrigin)
+
+		if allowOrigin != "*" {
+			header.Add("Vary", "Origin")
+		}
+
+		if cfg.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if len(cfg.ExposedHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(cfg.ExposedHeaders, ", "))
+			}
+
+			c.Next()
+			return
+		}
+
+		// Routes are all registered by the time the first request arrives
+		routesOnce.Do(func() { routes = routeMethods(router) })
+
+		methods := cfg.methodsFor(routes, c.Request.URL.Path)
+
+		if len(methods) == 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, errorResponse{Error: "no such route"})
+			return
+		}
+
+		header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		header.Set("Access-Control-Allow-Headers", strings.Join(cfg.AllowedHeaders, ", "))
+
+		if cfg.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+		}
+
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+// allowOrigin returns the value for Access-Control-Allow-Origin, or false if
+// the origin isn't allowed. validate makes sure "*" never comes with
+// credentials, but it is checked here too so that any site can't make
+// credentialed requests if that is ever missed
+func (cfg corsConfig) allowOrigin(origin string) (string, bool) {
+	for _, allowed := range cfg.AllowedOrigins {
+		if allowed == "*" {
+			if cfg.AllowCredentials {
+				continue
+			}
+
+			return "*", true
+		}
+
+		if originMatches(strings.TrimSuffix(allowed, "/"), origin) {
+			return origin, true
+		}
+	}
+
+	return "", false
+}
+
+// originMatches compares an origin with an allowed one, where a port of "*"
+// matches any port or none
+func originMatches(allowed string, origin string) bool {
+	base, anyPort := strings.CutSuffix(allowed, ":*")
+
+	if !anyPort {
+		return strings.EqualFold(allowed, origin)
+	}
+
+	if strings.EqualFold(base, origin) {
+		return true
+	}
+
+	if len(origin) <= len(base)+1 || !strings.EqualFold(origin[:len(base)+1], base+":") {
+		return false
+	}
+
+	_, err := strconv.ParseUint(origin[len(base)+1:], 10, 16)
+
+	return err == nil
+}
+
+func (cfg corsConfig) validate() []string {
+	var problems []string
+
+	if cfg.MaxAge < 0 {
+		problems = append(problems, "cors maxAge cannot be negative")
+	}
+
+	if cfg.AllowCredentials && containsFold(cfg.AllowedOrigins, "*") {
+		problems = append(problems, `cors allowedOrigins cannot include "*" when allowCredentials is set, list the origins instead`)
+	}
+
+	return problems
+}
+
+// methodsFor works out the methods to offer for a request path: those
+// registered for the matching route, limited by the configuration
+func (cfg corsConfig) methodsFor(routes map[string][]string, path string) []string {
+	var methods []string
+
+	for route, registered := range routes {
+		if !routeMatches(route, path) {
+			continue
+		}
+
+		allowed := cfg.AllowedMethods
+
+		if override, ok := cfg.RouteMethods[route]; ok {
+			allowed = override
+		}
+
+		for _, method := range registered {
+			if containsFold(allowed, method) && !containsFold(methods, method) {
+				methods = append(methods, method)
+			}
+		}
+	}
+
+	return methods
+}
+
+// routeMethods collects the methods registered for each route
+func routeMethods(router *gin.Engine) map[string][]string {
+	routes := map[string][]string{}
+
+	for _, r := range router.Routes() {
+		routes[r.Path] = append(routes[r.Path], r.Method)
+	}
+
+	return routes
+}
+
+// routeMatches compares a request path with a gin route, where ":name"
+// matches any one segment and "*name" matches the rest of the path
+func routeMatches(route string, path string) bool {
+	routeParts := strings.Split(strings.Trim(route, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+
+	for i, part := range routeParts {
+		if strings.HasPrefix(part, "*") {
+			return true
+		}
+
+		if i >= len(pathParts) {
+			return false
+		}
+
+		if !strings.HasPrefix(part, ":") && part != pathParts[i] {
+			return false
+		}
+	}
+
+	return len(routeParts) == len(pathParts)
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sony PTP property codes for camera modes. Changing any of these can change
+// which properties are writable and what options they offer
+const (
+	propertyIdExposureProgramMode = 0x500E
+	propertyIdStillCaptureMode    = 0x5013
+)
+
+var modePropertyIds = map[uint]bool{
+	propertyIdExposureProgramMode: true,
+	propertyIdStillCaptureMode:    true,
+	propertyIdWhiteBalance:        true,
+}
+
+// cachedDescriptors is a complete set of descriptors read from a camera,
+// tagged with a hash of their content so clients can revalidate cheaply
+type cachedDescriptors struct {
+	Descriptors []propertyDescriptor
+	ETag        string
+	Fetched     time.Time
+}
+
+// descriptorCache holds the descriptors for one camera. fetchLock is held
+// while reading them from the camera, so concurrent requests wait for the
+// one fetch rather than each making hundreds of DLL calls
+type descriptorCache struct {
+	fetchLock  sync.Mutex
+	entry      *cachedDescriptors
+	generation uint64
+}
+
+var (
+	descriptorCachesLock sync.Mutex
+	descriptorCaches     = map[uintptr]*descriptorCache{}
+)
+
+// cachedPropertyDescriptors returns the descriptors for a camera, reading
+// them from the camera only if they aren't already cached
+func cachedPropertyDescriptors(ctx context.Context, hCamera uintptr) (*cachedDescriptors, error) {
+	descriptorCachesLock.Lock()
+	cache, ok := descriptorCaches[hCamera]
+
+	if !ok {
+		cache = &descriptorCache{}
+		descriptorCaches[hCamera] = cache
+	}
+	descriptorCachesLock.Unlock()
+
+	cache.fetchLock.Lock()
+	defer cache.fetchLock.Unlock()
+
+	descriptorCachesLock.Lock()
+	entry := cache.entry
+	generation := cache.generation
+	descriptorCachesLock.Unlock()
+
+	if entry != nil {
+		return entry, nil
+	}
+
+	descriptors, err := fetchPropertyDescriptors(ctx, hCamera)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entry = &cachedDescriptors{Descriptors: descriptors, ETag: descriptorsETag(descriptors), Fetched: time.Now()}
+
+	// If the cache was invalidated while we were reading, what we have may
+	// already be out of date. It is still the best answer for this request
+	descriptorCachesLock.Lock()
+	if cache.generation == generation && descriptorCaches[hCamera] == cache {
+		cache.entry = entry
+	}
+	descriptorCachesLock.Unlock()
+
+	return entry, nil
+}
+
+// fetchPropertyDescriptors reads every descriptor from the camera
+func fetchPropertyDescriptors(ctx context.Context, hCamera uintptr) ([]propertyDescriptor, error) {
+	ids, err := fetchPropertyIds(ctx, hCamera)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var descriptors []propertyDescriptor
+
+	for _, id := range ids {
+		pd, err := fetchPropertyDescriptor(ctx, hCamera, id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		descriptors = append(descriptors, pd)
+	}
+
+	return descriptors, nil
+}
+
+// invalidatePropertyDescriptors drops the cached descriptors for a camera,
+// letting anyone watching it know they should fetch them again
+func invalidatePropertyDescriptors(hCamera uintptr) {
+	descriptorCachesLock.Lock()
+	cache, ok := descriptorCaches[hCamera]
+	wasCached := ok && cache.entry != nil
+
+	if ok {
+		cache.entry = nil
+		cache.generation++
+	}
+	descriptorCachesLock.Unlock()
+
+	if wasCached {
+		publishCameraEvent(hCamera, cameraEvent{Type: cameraEventDescriptors, Time: time.Now()})
+	}
+}
+
+// forgetPropertyDescriptors is used when a camera is closed
+func forgetPropertyDescriptors(hCamera uintptr) {
+	descriptorCachesLock.Lock()
+	delete(descriptorCaches, hCamera)
+	descriptorCachesLock.Unlock()
+}
+
+// invalidateOnModeChange drops the cached descriptors if any of the changed
+// properties is one that switches camera mode
+func invalidateOnModeChange(hCamera uintptr, changed []uint) {
+	for _, id := range changed {
+		if modePropertyIds[id] {
+			invalidatePropertyDescriptors(hCamera)
+			return
+		}
+	}
+}
+
+func descriptorsETag(descriptors []propertyDescriptor) string {
+	b, _ := json.Marshal(descriptors)
+	sum := sha256.Sum256(b)
+
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches checks an If-None-Match header, which can list several tags or
+// be "*"
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
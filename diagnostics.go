@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/gin-gonic/gin"
+)
+
+// version is set when building a release, with
+// -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+// dllCheckTimeout is how long a check waits for the system worker, which may
+// be busy with (or stuck in) another call
+const dllCheckTimeout = 5 * time.Second
+
+var procGetModuleFileName = syscall.NewLazyDLL("kernel32.dll").NewProc("GetModuleFileNameW")
+
+// dllProcs are the DLL functions we use
+var dllProcs = []*syscall.LazyProc{
+	procGetCameraInfo,
+	procGetDeviceInfo,
+	procGetPropertyDescriptor,
+	procGetPropertyValueOption,
+	procCloseDevice,
+	procGetPortableDeviceCount,
+	procGetPortableDeviceInfo,
+	procOpenDeviceEx,
+	procGetPropertyList,
+	procGetAllPropertyValues,
+	procGetPreviewImage,
+	procSetPropertyValue,
+	procStartCapture,
+	procGetCaptureStatus,
+	procGetImage,
+	procCancelCapture,
+}
+
+var (
+	startedAt = time.Now()
+	// dllLoaded is the result of the last checkDLL, /healthz reports it
+	// rather than checking again
+	dllLoaded atomic.Bool
+)
+
+type dllStatus struct {
+	// Name is the DLL as configured, Path the file Windows actually loaded
+	Name   string `json:"name"`
+	Path   string `json:"path,omitempty"`
+	Loaded bool   `json:"loaded"`
+	// WorkerBusy means the system worker didn't get to the check in time,
+	// Loaded is then as of the last check that did run
+	WorkerBusy bool         `json:"workerBusy,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Procs      []procStatus `json:"procs"`
+}
+
+type procStatus struct {
+	Name     string `json:"name"`
+	Resolved bool   `json:"resolved"`
+	Error    string `json:"error,omitempty"`
+}
+
+type workerStatus struct {
+	Name           string `json:"name"`
+	Handle         uint64 `json:"handle,omitempty"`
+	COMInitialized bool   `json:"comInitialized"`
+}
+
+type buildStatus struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+type readyResponse struct {
+	Ready    bool     `json:"ready"`
+	Problems []string `json:"problems"`
+}
+
+type diagnosticsResponse struct {
+	readyResponse
+	Build   buildStatus    `json:"build"`
+	Started time.Time      `json:"started"`
+	Uptime  string         `json:"uptime"`
+	DLL     dllStatus      `json:"dll"`
+	Workers []workerStatus `json:"workers"`
+	Cameras []sessionInfo  `json:"cameras"`
+}
+
+// getReady answers 503 until the DLL and everything it needs is in place,
+// and whenever an open camera has stopped responding or dropped off the bus
+func getReady(c *gin.Context) {
+	result := checkReady(checkDLL(c.Request.Context()), listWorkers(), listSessions())
+
+	status := http.StatusOK
+
+	if !result.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	c.IndentedJSON(status, result)
+}
+
+// getDiagnostics reports everything /readyz bases its answer on, plus how
+// each camera has been doing
+func getDiagnostics(c *gin.Context) {
+	dll := checkDLL(c.Request.Context())
+	workers := listWorkers()
+	cameras := listSessions()
+
+	c.IndentedJSON(http.StatusOK, diagnosticsResponse{
+		readyResponse: checkReady(dll, workers, cameras),
+		Build:         currentBuild(),
+		Started:       startedAt,
+		Uptime:        time.Since(startedAt).Round(time.Second).String(),
+		DLL:           dll,
+		Workers:       workers,
+		Cameras:       cameras,
+	})
+}
+
+func checkReady(dll dllStatus, workers []workerStatus, cameras []sessionInfo) readyResponse {
+	problems := []string{}
+
+	if dll.WorkerBusy {
+		problems = append(problems, "system worker is busy, device enumeration may be stuck")
+	}
+
+	if !dll.Loaded {
+		problems = append(problems, fmt.Sprintf("%s is not loaded: %s", dll.Name, dll.Error))
+	}
+
+	for _, p := range dll.Procs {
+		if !p.Resolved {
+			problems = append(problems, fmt.Sprintf("%s is missing from %s", p.Name, dll.Name))
+		}
+	}
+
+	for _, w := range workers {
+		if !w.COMInitialized {
+			problems = append(problems, fmt.Sprintf("COM is not initialized on worker %s", w.Name))
+		}
+	}
+
+	for _, s := range cameras {
+		switch {
+		case s.Disconnected:
+			problems = append(problems, fmt.Sprintf("camera %d is disconnected", s.Handle))
+		case !s.Healthy:
+			problems = append(problems, fmt.Sprintf("camera %d has not responded since %s", s.Handle, s.UnhealthySince.Format(time.RFC3339)))
+		}
+	}
+
+	return readyResponse{Ready: len(problems) == 0, Problems: problems}
+}
+
+// checkDLL loads the DLL if it isn't already, and looks up every function we
+// use. LoadLibrary runs the DLL's own start up code, so like every other call
+// into it this happens on the system worker
+func checkDLL(ctx context.Context) dllStatus {
+	ctx, cancel := context.WithTimeout(ctx, dllCheckTimeout)
+	defer cancel()
+
+	status := dllStatus{Name: cameraDLL.Name, Procs: []procStatus{}}
+	loaded := make(chan error, 1)
+
+	err := systemWorker.do(ctx, func() { loaded <- cameraDLL.Load() })
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled):
+		// Not knowing isn't the same as not loaded, so the last answer stands
+		status.WorkerBusy = true
+
+		if !dllLoaded.Load() {
+			status.Error = "system worker busy, unable to load the DLL"
+			return status
+		}
+	case err != nil:
+		dllLoaded.Store(false)
+		status.Error = err.Error()
+		return status
+	default:
+		err = <-loaded
+		dllLoaded.Store(err == nil)
+
+		if err != nil {
+			status.Error = err.Error()
+			return status
+		}
+	}
+
+	// Once loaded the DLL stays loaded, so looking up functions doesn't need
+	// the worker
+	status.Loaded = true
+	status.Path = modulePath(syscall.Handle(cameraDLL.Handle()))
+
+	for _, p := range dllProcs {
+		proc := procStatus{Name: p.Name}
+
+		if err := p.Find(); err != nil {
+			proc.Error = err.Error()
+		} else {
+			proc.Resolved = true
+		}
+
+		status.Procs = append(status.Procs, proc)
+	}
+
+	return status
+}
+
+// modulePath returns the file a loaded module came from
+func modulePath(module syscall.Handle) string {
+	buffer := make([]uint16, syscall.MAX_LONG_PATH)
+
+	n, _, _ := procGetModuleFileName.Call(uintptr(module), uintptr(unsafe.Pointer(&buffer[0])), uintptr(len(buffer)))
+
+	return syscall.UTF16ToString(buffer[:n])
+}
+
+// listWorkers returns the system worker followed by each camera's
+func listWorkers() []workerStatus {
+	workers := []workerStatus{{Name: systemWorker.name, COMInitialized: systemWorker.comInitialized}}
+
+	sessionsLock.Lock()
+	for _, s := range sessions {
+		workers = append(workers, workerStatus{Name: s.worker.name, Handle: s.Handle, COMInitialized: s.worker.comInitialized})
+	}
+	sessionsLock.Unlock()
+
+	sort.Slice(workers[1:], func(i, j int) bool { return workers[i+1].Handle < workers[j+1].Handle })
+
+	return workers
+}
+
+func currentBuild() buildStatus {
+	build := buildStatus{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	info, ok := debug.ReadBuildInfo()
+
+	if !ok {
+		return build
+	}
+
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			build.Revision = setting.Value
+		case "vcs.time":
+			build.Time = setting.Value
+		case "vcs.modified":
+			build.Modified = setting.Value == "true"
+		}
+	}
+
+	return build
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cameraEventPollInterval is how often a watched camera is checked for
+// property and capture changes
+var cameraEventPollInterval = time.Second
+
+const (
+	// cameraEventBuffer is how many events a subscriber can fall behind
+	// before it is dropped
+	cameraEventBuffer = 64
+	// sseKeepAliveInterval stops proxies timing out quiet event streams
+	sseKeepAliveInterval = 15 * time.Second
+)
+
+// Camera event types
+const (
+	cameraEventProperties   = "properties"
+	cameraEventCapture      = "capture"
+	cameraEventDisconnected = "disconnected"
+	cameraEventConnected    = "connected"
+	cameraEventDescriptors  = "descriptors"
+	cameraEventLease        = "lease"
+)
+
+type cameraEvent struct {
+	Type       string          `json:"type"`
+	Time       time.Time       `json:"time"`
+	Version    uint64          `json:"version,omitempty"`
+	Properties []propertyValue `json:"properties,omitempty"`
+	Capture    *capture        `json:"capture,omitempty"`
+	// Lease is the new lease for lease events, nil once it has been released
+	// or has expired
+	Lease *lease `json:"lease,omitempty"`
+}
+
+// cameraWatcher polls a camera once on behalf of everyone subscribed to its
+// events, diffing each snapshot against the previous one
+type cameraWatcher struct {
+	hCamera uintptr
+
+	lock        sync.Mutex
+	subscribers map[*cameraEventSubscription]struct{}
+	properties  []propertyValue
+	version     uint64
+	lastPoll    time.Time
+	// captureStates holds the last state published for captures still in
+	// progress, finished ones are dropped once their final state has gone out
+	captureStates map[string]string
+	disconnected  bool
+	stopped       bool
+}
+
+type cameraEventSubscription struct {
+	watcher *cameraWatcher
+	Events  chan cameraEvent
+}
+
+var (
+	cameraWatchersLock sync.Mutex
+	cameraWatchers     = map[uintptr]*cameraWatcher{}
+)
+
+// getEvents streams camera events to the client as Server-Sent Events
+func getEvents(c *gin.Context) {
+	hCamera := getCameraHandleFromPath(c)
+
+	sub, err := subscribeCameraEvents(hCamera)
+
+	if err != nil {
+		c.IndentedJSON(http.StatusServiceUnavailable, errorResponse{Error: err.Error()})
+		return
+	}
+	defer sub.Close()
+
+	streamEvents(c, sub.Events, func(event cameraEvent) string { return event.Type })
+}
+
+// streamEvents writes everything from a channel as Server-Sent Events, named
+// by the function given, until the client goes away or the channel is closed.
+// Quiet streams get a ping every sseKeepAliveInterval
+func streamEvents[E any](c *gin.Context, events <-chan E, name func(E) string) {
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	ctx := c.Request.Context()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			c.SSEvent(name(event), event)
+		case <-keepAlive.C:
+			c.SSEvent("ping", emptyResponse{})
+		}
+
+		c.Writer.Flush()
+	}
+}
+
+// subscribeCameraEvents starts watching a camera (if nobody else is) and
+// returns a subscription whose Events channel receives everything that
+// happens to it. The channel is closed if the subscriber falls too far behind
+// or the camera is closed
+func subscribeCameraEvents(hCamera uintptr) (*cameraEventSubscription, error) {
+	cameraWatchersLock.Lock()
+	defer cameraWatchersLock.Unlock()
+
+	if shuttingDown.Load() {
+		return nil, errShuttingDown
+	}
+
+	w, ok := cameraWatchers[hCamera]
+
+	if !ok {
+		w = &cameraWatcher{
+			hCamera:       hCamera,
+			subscribers:   map[*cameraEventSubscription]struct{}{},
+			captureStates: map[string]string{},
+		}
+		cameraWatchers[hCamera] = w
+
+		go w.run()
+	}
+
+	sub := &cameraEventSubscription{watcher: w, Events: make(chan cameraEvent, cameraEventBuffer)}
+
+	w.lock.Lock()
+	w.subscribers[sub] = struct{}{}
+
+	// Late subscribers get the current state straight away rather than waiting
+	// for something to change
+	if w.properties != nil {
+		sub.Events <- cameraEvent{Type: cameraEventProperties, Time: time.Now(), Version: w.version, Properties: w.properties}
+	}
+	w.lock.Unlock()
+
+	return sub, nil
+}
+
+func (s *cameraEventSubscription) Close() {
+	w := s.watcher
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if _, ok := w.subscribers[s]; ok {
+		delete(w.subscribers, s)
+		close(s.Events)
+	}
+}
+
+// publishCameraEvent sends an event to everyone watching a camera, it does
+// nothing if nobody is
+func publishCameraEvent(hCamera uintptr, event cameraEvent) {
+	cameraWatchersLock.Lock()
+	w, ok := cameraWatchers[hCamera]
+	cameraWatchersLock.Unlock()
+
+	if ok {
+		w.publish(event)
+	}
+}
+
+// stopCameraEvents stops watching a camera, closing every subscription. It
+// returns how many subscriptions were closed
+func stopCameraEvents(hCamera uintptr) int {
+	cameraWatchersLock.Lock()
+	defer cameraWatchersLock.Unlock()
+
+	w, ok := cameraWatchers[hCamera]
+
+	if !ok {
+		return 0
+	}
+
+	w.lock.Lock()
+	subscribers := len(w.subscribers)
+	w.lock.Unlock()
+
+	w.stop()
+
+	return subscribers
+}
+
+func (w *cameraWatcher) run() {
+	ticker := time.NewTicker(cameraEventPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if !w.active() {
+			return
+		}
+
+		w.poll()
+
+		<-ticker.C
+	}
+}
+
+// active reports whether the watcher should keep going, stopping it if the
+// last subscriber has gone
+func (w *cameraWatcher) active() bool {
+	cameraWatchersLock.Lock()
+	defer cameraWatchersLock.Unlock()
+
+	w.lock.Lock()
+	stopped := w.stopped
+	idle := len(w.subscribers) == 0
+	w.lock.Unlock()
+
+	if !stopped && idle {
+		w.stop()
+		return false
+	}
+
+	return !stopped
+}
+
+func (w *cameraWatcher) poll() {
+	// Polling isn't tied to any one subscriber's request
+	latest, err := fetchPropertyValues(context.Background(), w.hCamera)
+	now := time.Now()
+
+	// A call that fails or times out is treated the same as a camera that
+	// has stopped answering
+	if err != nil {
+		latest = nil
+	}
+
+	var version uint64
+
+	if len(latest) > 0 {
+		version = recordPropertyValues(w.hCamera, latest)
+	}
+
+	w.lock.Lock()
+	previous := w.properties
+	wasDisconnected := w.disconnected
+	lastPoll := w.lastPoll
+	w.lastPoll = now
+
+	// A camera that has stopped answering returns no properties at all. The
+	// version is kept so late subscribers still get the last known state
+	if len(latest) == 0 {
+		w.disconnected = previous != nil
+	} else {
+		w.disconnected = false
+		w.properties = latest
+		w.version = version
+	}
+	w.lock.Unlock()
+
+	switch {
+	case len(latest) == 0 && previous != nil && !wasDisconnected:
+		w.publish(cameraEvent{Type: cameraEventDisconnected, Time: now})
+	case len(latest) > 0 && wasDisconnected:
+		w.publish(cameraEvent{Type: cameraEventConnected, Time: now})
+	}
+
+	if changed := diffPropertyValues(previous, latest); len(latest) > 0 && len(changed) > 0 {
+		w.publish(cameraEvent{Type: cameraEventProperties, Time: now, Version: version, Properties: changed})
+	}
+
+	w.publishCaptures(lastPoll, now)
+}
+
+// publishCaptures sends the state of every capture that has changed since the
+// last poll. Finished captures are kept around for a while, so one we have no
+// state for is only new if it finished after the last poll
+func (w *cameraWatcher) publishCaptures(lastPoll time.Time, now time.Time) {
+	current := map[string]bool{}
+
+	for _, cp := range capturesForCamera(w.hCamera) {
+		snapshot := cp
+		current[cp.ID] = true
+
+		w.lock.Lock()
+		state, seen := w.captureStates[cp.ID]
+		finished := snapshot.finished()
+
+		changed := state != cp.State
+
+		if !seen && finished {
+			changed = cp.Finished != nil && cp.Finished.After(lastPoll)
+		}
+
+		if finished {
+			delete(w.captureStates, cp.ID)
+		} else {
+			w.captureStates[cp.ID] = cp.State
+		}
+		w.lock.Unlock()
+
+		if changed {
+			w.publish(cameraEvent{Type: cameraEventCapture, Time: now, Capture: &snapshot})
+		}
+	}
+
+	// Captures deleted while still in progress
+	w.lock.Lock()
+	for id := range w.captureStates {
+		if !current[id] {
+			delete(w.captureStates, id)
+		}
+	}
+	w.lock.Unlock()
+}
+
+func (w *cameraWatcher) publish(event cameraEvent) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for sub := range w.subscribers {
+		select {
+		case sub.Events <- event:
+		default:
+			// Too slow to keep up, closing lets the client reconnect and resync
+			delete(w.subscribers, sub)
+			close(sub.Events)
+		}
+	}
+}
+
+// diffPropertyValues returns the properties in latest that are new or whose
+// value differs from previous
+func diffPropertyValues(previous []propertyValue, latest []propertyValue) []propertyValue {
+	known := map[uint]propertyValue{}
+
+	for _, p := range previous {
+		known[p.ID] = p
+	}
+
+	var changed []propertyValue
+
+	for _, p := range latest {
+		if old, ok := known[p.ID]; !ok || old.Value != p.Value || old.Text != p.Text {
+			changed = append(changed, p)
+		}
+	}
+
+	return changed
+}
+
+// stop must be called with cameraWatchersLock held
+func (w *cameraWatcher) stop() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.stopped {
+		return
+	}
+
+	w.stopped = true
+
+	for sub := range w.subscribers {
+		delete(w.subscribers, sub)
+		close(sub.Events)
+	}
+
+	if cameraWatchers[w.hCamera] == w {
+		delete(cameraWatchers, w.hCamera)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Sony PTP property codes for the values we expose as "exposure"
+const (
+	propertyIdWhiteBalance     = 0x5005
+	propertyIdFNumber          = 0x5007
+	propertyIdExposureBias     = 0x5010
+	propertyIdShutterSpeed     = 0xD20D
+	propertyIdColorTemperature = 0xD20F
+	propertyIdISO              = 0xD21E
+)
+
+// exposureSettings is the human-friendly view of the camera exposure, every
+// field is optional so the same struct can be used for partial updates
+type exposureSettings struct {
+	ISO           *uint    `json:"iso,omitempty"`
+	Shutter       *string  `json:"shutter,omitempty"`
+	Aperture      *float64 `json:"aperture,omitempty"`
+	EV            *float64 `json:"ev,omitempty"`
+	WhiteBalanceK *uint    `json:"whiteBalanceK,omitempty"`
+}
+
+// exposureAdjustment describes what happened to a single requested value
+type exposureAdjustment struct {
+	Requested string `json:"requested"`
+	Selected  string `json:"selected,omitempty"`
+	Value     uint   `json:"value"`
+	Exact     bool   `json:"exact"`
+	Error     string `json:"error,omitempty"`
+}
+
+type exposureResponse struct {
+	Requested   exposureSettings              `json:"requested"`
+	Applied     exposureSettings              `json:"applied"`
+	Adjustments map[string]exposureAdjustment `json:"adjustments"`
+	// Error is set when the values couldn't be read back, the adjustments
+	// still say what was changed
+	Error string `json:"error,omitempty"`
+}
+
+// exposureControl knows how to turn the text of a property (or one of its
+// enum options) into a number that can be compared with a requested value
+type exposureControl struct {
+	PropertyId uint
+	Parse      func(text string) (float64, bool)
+	// LogScale is set for values that go up in stops (ISO, shutter, aperture),
+	// where "nearest" should be measured as a ratio rather than a difference
+	LogScale bool
+}
+
+var (
+	isoControl      = exposureControl{PropertyId: propertyIdISO, Parse: parseISO, LogScale: true}
+	shutterControl  = exposureControl{PropertyId: propertyIdShutterSpeed, Parse: parseShutter, LogScale: true}
+	apertureControl = exposureControl{PropertyId: propertyIdFNumber, Parse: parseAperture, LogScale: true}
+	evControl       = exposureControl{PropertyId: propertyIdExposureBias, Parse: parseEV}
+	kelvinControl   = exposureControl{PropertyId: propertyIdColorTemperature, Parse: parseKelvin}
+)
+
+func getExposure(c *gin.Context) {
+	hCamera := getCameraHandleFromPath(c)
+
+	settings, err := currentExposure(c.Request.Context(), hCamera)
+
+	if err != nil {
+		abortWithCameraError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, settings)
+}
+
+func putExposure(c *gin.Context) {
+	hCamera := getCameraHandleFromPath(c)
+
+	in := exposureSettings{}
+
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	result, err := applyExposure(c.Request.Context(), hCamera, in)
+
+	// Some values may already have been changed, so the caller gets those
+	// along with the error
+	if err != nil {
+		result.Error = err.Error()
+		c.IndentedJSON(cameraErrorStatus(err), result)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, result)
+}
+
+// applyExposure sets each of the requested values and reports what the
+// camera ended up with. Values the camera refuses are reported in the
+// adjustments, the error is only for failing to read the result back
+func applyExposure(ctx context.Context, hCamera uintptr, in exposureSettings) (exposureResponse, error) {
+	result := exposureResponse{Requested: in, Adjustments: map[string]exposureAdjustment{}}
+
+	if in.ISO != nil {
+		result.Adjustments["iso"] = applyExposureValue(ctx, hCamera, isoControl, strconv.Itoa(int(*in.ISO)))
+	}
+
+	if in.Shutter != nil {
+		result.Adjustments["shutter"] = applyExposureValue(ctx, hCamera, shutterControl, *in.Shutter)
+	}
+
+	if in.Aperture != nil {
+		result.Adjustments["aperture"] = applyExposureValue(ctx, hCamera, apertureControl, strconv.FormatFloat(*in.Aperture, 'f', -1, 64))
+	}
+
+	if in.EV != nil {
+		result.Adjustments["ev"] = applyExposureValue(ctx, hCamera, evControl, strconv.FormatFloat(*in.EV, 'f', -1, 64))
+	}
+
+	if in.WhiteBalanceK != nil {
+		result.Adjustments["whiteBalanceK"] = applyWhiteBalanceK(ctx, hCamera, *in.WhiteBalanceK)
+	}
+
+	// Read everything back, the camera may have adjusted more than we asked for
+	applied, err := currentExposure(ctx, hCamera)
+	result.Applied = applied
+
+	return result, err
+}
+
+// currentExposure reads the property values and converts the ones we know
+// about into human values
+func currentExposure(ctx context.Context, hCamera uintptr) (exposureSettings, error) {
+	var settings exposureSettings
+
+	properties, err := fetchPropertyValues(ctx, hCamera)
+
+	if err != nil {
+		return settings, err
+	}
+
+	for _, property := range properties {
+		switch property.ID {
+		case propertyIdISO:
+			if v, ok := parseISO(property.Text); ok {
+				iso := uint(v)
+				settings.ISO = &iso
+			}
+		case propertyIdShutterSpeed:
+			if _, ok := parseShutter(property.Text); ok {
+				shutter := property.Text
+				settings.Shutter = &shutter
+			}
+		case propertyIdFNumber:
+			if v, ok := parseAperture(property.Text); ok {
+				settings.Aperture = &v
+			}
+		case propertyIdExposureBias:
+			if v, ok := parseEV(property.Text); ok {
+				settings.EV = &v
+			}
+		case propertyIdColorTemperature:
+			if v, ok := parseKelvin(property.Text); ok {
+				k := uint(v)
+				settings.WhiteBalanceK = &k
+			}
+		}
+	}
+
+	return settings, nil
+}
+
+// applyExposureValue picks the enum option closest to the requested value and
+// sets it on the camera
+func applyExposureValue(ctx context.Context, hCamera uintptr, control exposureControl, requested string) exposureAdjustment {
+	adjustment := exposureAdjustment{Requested: requested}
+
+	want, ok := control.Parse(requested)
+
+	if !ok {
+		adjustment.Error = fmt.Sprintf("unable to understand value %q", requested)
+		return adjustment
+	}
+
+	pd, err := fetchPropertyDescriptor(ctx, hCamera, control.PropertyId)
+
+	if err != nil {
+		adjustment.Error = err.Error()
+		return adjustment
+	}
+
+	if len(pd.Values) == 0 {
+		adjustment.Error = "value cannot be changed in the current camera mode"
+		return adjustment
+	}
+
+	option, distance, found := nearestOption(pd.Values, control, want)
+
+	if !found {
+		adjustment.Error = "camera did not report any usable options"
+		return adjustment
+	}
+
+	adjustment.Selected = option.Name
+	adjustment.Value = option.Value
+	adjustment.Exact = distance < 0.01
+
+	if err := setPropertyValue(ctx, hCamera, control.PropertyId, option.Value); err != nil {
+		adjustment.Error = err.Error()
+	}
+
+	return adjustment
+}
+
+// applyWhiteBalanceK switches the camera into colour temperature white balance
+// and then sets the requested temperature
+func applyWhiteBalanceK(ctx context.Context, hCamera uintptr, kelvin uint) exposureAdjustment {
+	adjustment := exposureAdjustment{Requested: fmt.Sprintf("%dK", kelvin)}
+
+	wb, err := fetchPropertyDescriptor(ctx, hCamera, propertyIdWhiteBalance)
+
+	if err != nil {
+		adjustment.Error = err.Error()
+		return adjustment
+	}
+
+	modeSet := false
+
+	for _, option := range wb.Values {
+		if strings.Contains(strings.ToLower(option.Name), "temp") {
+			if err := setPropertyValue(ctx, hCamera, propertyIdWhiteBalance, option.Value); err != nil {
+				adjustment.Error = err.Error()
+				return adjustment
+			}
+
+			modeSet = true
+			break
+		}
+	}
+
+	if !modeSet {
+		adjustment.Error = "camera does not offer a colour temperature white balance mode"
+		return adjustment
+	}
+
+	pd, err := fetchPropertyDescriptor(ctx, hCamera, propertyIdColorTemperature)
+
+	if err != nil {
+		adjustment.Error = err.Error()
+		return adjustment
+	}
+
+	// Most bodies report colour temperature as a range rather than an enum, in
+	// which case we just send it rounded to the usual 100K step
+	if len(pd.Values) == 0 {
+		value := uint(math.Round(float64(kelvin)/100) * 100)
+
+		adjustment.Selected = fmt.Sprintf("%dK", value)
+		adjustment.Value = value
+		adjustment.Exact = value == kelvin
+
+		if err := setPropertyValue(ctx, hCamera, propertyIdColorTemperature, value); err != nil {
+			adjustment.Error = err.Error()
+		}
+
+		return adjustment
+	}
+
+	return applyExposureValue(ctx, hCamera, kelvinControl, strconv.Itoa(int(kelvin)))
+}
+
+// nearestOption returns the option whose parsed value is closest to want,
+// along with how far away it was
+func nearestOption(options []propertyValueOption, control exposureControl, want float64) (propertyValueOption, float64, bool) {
+	var best propertyValueOption
+	bestDistance := math.Inf(1)
+	found := false
+
+	for _, option := range options {
+		v, ok := control.Parse(option.Name)
+
+		if !ok {
+			continue
+		}
+
+		var distance float64
+
+		if control.LogScale {
+			if v <= 0 || want <= 0 {
+				continue
+			}
+
+			distance = math.Abs(math.Log2(v / want))
+		} else {
+			distance = math.Abs(v - want)
+		}
+
+		if distance < bestDistance {
+			best = option
+			bestDistance = distance
+			found = true
+		}
+	}
+
+	return best, bestDistance, found
+}
+
+func setPropertyValue(ctx context.Context, hCamera uintptr, id uint, value uint) error {
+	hr, err := callCamera(ctx, hCamera, procSetPropertyValue, id, value)
+
+	if err != nil {
+		return err
+	}
+
+	if hr != 0 {
+		return fmt.Errorf("camera rejected value x%04x for property x%04x (error %d)", value, id, hr)
+	}
+
+	// Remember it so it can be put back if the camera has to be reopened
+	if s := lookupSession(uint64(hCamera)); s != nil {
+		s.recordApplied(id, value)
+	}
+
+	invalidateOnModeChange(hCamera, []uint{id})
+
+	return nil
+}
+
+func parseISO(text string) (float64, bool) {
+	text = strings.TrimSpace(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(text)), "ISO"))
+
+	v, err := strconv.ParseFloat(text, 64)
+
+	return v, err == nil && v > 0
+}
+
+// parseShutter understands "1/125", "0.5", "2\"" and "30s" style shutter speeds
+func parseShutter(text string) (float64, bool) {
+	text = strings.TrimSpace(text)
+	text = strings.TrimRight(text, "\"s")
+
+	if numerator, denominator, found := strings.Cut(text, "/"); found {
+		n, err := strconv.ParseFloat(strings.TrimSpace(numerator), 64)
+
+		if err != nil {
+			return 0, false
+		}
+
+		d, err := strconv.ParseFloat(strings.TrimSpace(denominator), 64)
+
+		if err != nil || d == 0 {
+			return 0, false
+		}
+
+		return n / d, true
+	}
+
+	v, err := strconv.ParseFloat(text, 64)
+
+	return v, err == nil && v > 0
+}
+
+func parseAperture(text string) (float64, bool) {
+	text = strings.TrimSpace(text)
+	text = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(text), "f"), "/")
+
+	v, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+
+	return v, err == nil && v > 0
+}
+
+func parseEV(text string) (float64, bool) {
+	text = strings.TrimSpace(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(text)), "EV"))
+	text = strings.TrimPrefix(text, "+")
+
+	v, err := strconv.ParseFloat(text, 64)
+
+	return v, err == nil
+}
+
+func parseKelvin(text string) (float64, bool) {
+	text = strings.TrimSpace(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(text)), "K"))
+
+	v, err := strconv.ParseFloat(text, 64)
+
+	return v, err == nil && v > 0
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type healthResponse struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+	// DLLLoaded is as of the last check, /readyz and /diagnostics check again
+	DLLLoaded bool `json:"dllLoaded"`
+	// Timeouts are the per-operation limits applied to DLL calls
+	Timeouts       map[string]string `json:"timeouts"`
+	DefaultTimeout string            `json:"defaultTimeout"`
+	Cameras        []cameraHealth    `json:"cameras"`
+}
+
+type cameraHealth struct {
+	Handle         uint64     `json:"handle"`
+	Alias          string     `json:"alias,omitempty"`
+	Healthy        bool       `json:"healthy"`
+	UnhealthySince *time.Time `json:"unhealthySince,omitempty"`
+	Disconnected   bool       `json:"disconnected"`
+	LastError      string     `json:"lastError,omitempty"`
+}
+
+// getHealth reports "degraded" while the DLL isn't loaded, or any open camera
+// is stuck in a call that has timed out or has dropped off the bus. It never
+// touches the DLL itself, so it answers even when that is stuck
+func getHealth(c *gin.Context) {
+	result := healthResponse{
+		Status:         "ok",
+		Version:        version,
+		DLLLoaded:      dllLoaded.Load(),
+		Timeouts:       map[string]string{},
+		DefaultTimeout: defaultOperationTimeout.String(),
+		Cameras:        []cameraHealth{},
+	}
+
+	if !result.DLLLoaded {
+		result.Status = "degraded"
+	}
+
+	for name, timeout := range operationTimeouts {
+		result.Timeouts[name] = timeout.String()
+	}
+
+	for _, s := range listSessions() {
+		if !s.Healthy || s.Disconnected {
+			result.Status = "degraded"
+		}
+
+		result.Cameras = append(result.Cameras, cameraHealth{
+			Handle:         s.Handle,
+			Alias:          s.Alias,
+			Healthy:        s.Healthy,
+			UnhealthySince: s.UnhealthySince,
+			Disconnected:   s.Disconnected,
+			LastError:      s.LastError,
+		})
+	}
+
+	c.IndentedJSON(http.StatusOK, result)
+}
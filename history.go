@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxPropertyWait caps how long a long-poll for property changes can block
+const maxPropertyWait = 2 * time.Minute
+
+// propertyHistory remembers the last known value of each property on a camera
+// and the version at which it last changed, so clients can ask for just the
+// changes since a version they have already seen
+type propertyHistory struct {
+	version   uint64
+	values    map[uint]propertyValue
+	changedAt map[uint]uint64
+}
+
+var (
+	propertyHistoriesLock sync.Mutex
+	propertyHistories     = map[uintptr]*propertyHistory{}
+	// lastPropertyVersion is shared by all cameras so versions never go
+	// backwards, even if a camera is closed and reopened
+	lastPropertyVersion uint64
+)
+
+// recordPropertyValues merges a fresh snapshot into the camera history. If
+// anything changed the version is bumped. The current version is returned
+func recordPropertyValues(hCamera uintptr, latest []propertyValue) uint64 {
+	version, changed := mergePropertyValues(hCamera, latest)
+
+	// The first snapshot isn't a change of mode, everything is just new
+	if len(changed) > 0 {
+		invalidateOnModeChange(hCamera, changed)
+	}
+
+	return version
+}
+
+// mergePropertyValues does the work for recordPropertyValues, returning the
+// properties that changed from a value we already knew
+func mergePropertyValues(hCamera uintptr, latest []propertyValue) (uint64, []uint) {
+	propertyHistoriesLock.Lock()
+	defer propertyHistoriesLock.Unlock()
+
+	h, ok := propertyHistories[hCamera]
+
+	if !ok {
+		h = &propertyHistory{values: map[uint]propertyValue{}, changedAt: map[uint]uint64{}}
+		propertyHistories[hCamera] = h
+	}
+
+	var changed, modified []uint
+
+	for _, p := range latest {
+		if old, ok := h.values[p.ID]; !ok || old.Value != p.Value || old.Text != p.Text {
+			h.values[p.ID] = p
+			changed = append(changed, p.ID)
+
+			if ok {
+				modified = append(modified, p.ID)
+			}
+		}
+	}
+
+	if len(changed) > 0 {
+		lastPropertyVersion++
+		h.version = lastPropertyVersion
+
+		for _, id := range changed {
+			h.changedAt[id] = h.version
+		}
+	}
+
+	return h.version, modified
+}
+
+// propertyChangesSince returns the current version and every property that
+// has changed after the given version. A version we have never issued (for
+// example one from before a restart) returns everything
+func propertyChangesSince(hCamera uintptr, since uint64) (uint64, []propertyValue) {
+	propertyHistoriesLock.Lock()
+	defer propertyHistoriesLock.Unlock()
+
+	changes := []propertyValue{}
+	h, ok := propertyHistories[hCamera]
+
+	if !ok {
+		return 0, changes
+	}
+
+	if since > h.version {
+		since = 0
+	}
+
+	for id, p := range h.values {
+		if h.changedAt[id] > since {
+			changes = append(changes, p)
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ID < changes[j].ID })
+
+	return h.version, changes
+}
+
+// forgetPropertyHistory is used when a camera is closed
+func forgetPropertyHistory(hCamera uintptr) {
+	propertyHistoriesLock.Lock()
+	delete(propertyHistories, hCamera)
+	propertyHistoriesLock.Unlock()
+}
+
+// waitForPropertyChanges returns the properties changed since a version,
+// waiting up to the given time for something to change if nothing has yet
+func waitForPropertyChanges(ctx context.Context, hCamera uintptr, since uint64, wait time.Duration) (uint64, []propertyValue) {
+	version, changes := propertyChangesSince(hCamera, since)
+
+	if len(changes) > 0 || wait <= 0 {
+		return version, changes
+	}
+
+	// The event watcher does the polling (and records each snapshot), we just
+	// need to know when it has seen something
+	sub, err := subscribeCameraEvents(hCamera)
+
+	if err != nil {
+		return version, changes
+	}
+	defer sub.Close()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return version, changes
+		case <-timer.C:
+			return propertyChangesSince(hCamera, since)
+		case event, ok := <-sub.Events:
+			if !ok {
+				return propertyChangesSince(hCamera, since)
+			}
+
+			if event.Type != cameraEventProperties {
+				continue
+			}
+
+			if version, changes = propertyChangesSince(hCamera, since); len(changes) > 0 {
+				return version, changes
+			}
+		}
+	}
+}
+
+// parseWait accepts either a go duration ("30s") or a number of seconds
+func parseWait(wait string) (time.Duration, error) {
+	if wait == "" {
+		return 0, nil
+	}
+
+	d, err := parseSeconds("wait", wait)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if d > maxPropertyWait {
+		d = maxPropertyWait
+	}
+
+	return d, nil
+}
+
+// parseSeconds parses either a go duration ("30s") or a number of seconds,
+// name is used in the error
+func parseSeconds(name string, text string) (time.Duration, error) {
+	d, err := time.ParseDuration(text)
+
+	if err != nil {
+		seconds, convErr := strconv.ParseFloat(text, 64)
+
+		if convErr != nil {
+			return 0, fmt.Errorf("%s must be a duration such as 30s", name)
+		}
+
+		d = time.Duration(seconds * float64(time.Second))
+	}
+
+	if d < 0 {
+		return 0, fmt.Errorf("%s cannot be negative", name)
+	}
+
+	return d, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"Sony/Web/winstruct"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var deviceWatchInterval = 2 * time.Second
+
+// Device event types
+const (
+	deviceEventArrived = "arrived"
+	deviceEventRemoved = "removed"
+)
+
+type deviceEvent struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Device  device    `json:"device"`
+	Serial  string    `json:"serial,omitempty"`
+	Handles []uint64  `json:"handles,omitempty"`
+}
+
+var (
+	deviceSubscribersLock sync.Mutex
+	deviceSubscribers     = map[chan deviceEvent]struct{}{}
+)
+
+// getDeviceEvents streams device arrivals and removals as Server-Sent Events
+func getDeviceEvents(c *gin.Context) {
+	events, err := subscribeDeviceEvents()
+
+	if err != nil {
+		c.IndentedJSON(http.StatusServiceUnavailable, errorResponse{Error: err.Error()})
+		return
+	}
+	defer unsubscribeDeviceEvents(events)
+
+	streamEvents(c, events, func(event deviceEvent) string { return event.Type })
+}
+
+func subscribeDeviceEvents() (chan deviceEvent, error) {
+	deviceSubscribersLock.Lock()
+	defer deviceSubscribersLock.Unlock()
+
+	if shuttingDown.Load() {
+		return nil, errShuttingDown
+	}
+
+	events := make(chan deviceEvent, cameraEventBuffer)
+	deviceSubscribers[events] = struct{}{}
+
+	return events, nil
+}
+
+func unsubscribeDeviceEvents(events chan deviceEvent) {
+	deviceSubscribersLock.Lock()
+	defer deviceSubscribersLock.Unlock()
+
+	if _, ok := deviceSubscribers[events]; ok {
+		delete(deviceSubscribers, events)
+		close(events)
+	}
+}
+
+// closeDeviceSubscribers ends every device event stream, returning how many
+// there were
+func closeDeviceSubscribers() int {
+	deviceSubscribersLock.Lock()
+	defer deviceSubscribersLock.Unlock()
+
+	count := len(deviceSubscribers)
+
+	for events := range deviceSubscribers {
+		delete(deviceSubscribers, events)
+		close(events)
+	}
+
+	return count
+}
+
+func publishDeviceEvent(event deviceEvent) {
+	deviceSubscribersLock.Lock()
+	defer deviceSubscribersLock.Unlock()
+
+	for events := range deviceSubscribers {
+		select {
+		case events <- event:
+		default:
+			delete(deviceSubscribers, events)
+			close(events)
+		}
+	}
+}
+
+// watchDevices enumerates devices forever, reporting cameras that come and go
+// and flagging open handles whose camera has vanished
+func watchDevices() {
+	known := map[string]device{}
+
+	// Polling isn't tied to any request, each enumeration just gets the usual
+	// timeouts
+	ctx := context.Background()
+
+	if devices, err := enumerateDevices(ctx); err == nil {
+		for _, d := range devices {
+			known[d.ID] = d
+		}
+	}
+
+	ticker := time.NewTicker(deviceWatchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		devices, err := enumerateDevices(ctx)
+
+		// Treating a failed enumeration as "nothing connected" would flag
+		// every open camera as gone, so just try again next time
+		if err != nil {
+			continue
+		}
+
+		current := map[string]device{}
+
+		for _, d := range devices {
+			current[d.ID] = d
+		}
+
+		for id, d := range known {
+			if _, ok := current[id]; !ok {
+				deviceRemoved(d)
+			}
+		}
+
+		for id, d := range current {
+			if _, ok := known[id]; !ok {
+				deviceArrived(d)
+			}
+		}
+
+		known = current
+	}
+}
+
+func deviceRemoved(d device) {
+	now := time.Now()
+	handles := markDeviceDisconnected(d)
+
+	for _, handle := range handles {
+		publishCameraEvent(uintptr(handle), cameraEvent{Type: cameraEventDisconnected, Time: now})
+	}
+
+	publishDeviceEvent(deviceEvent{Type: deviceEventRemoved, Time: now, Device: d, Serial: serialFromDeviceId(d.ID), Handles: handles})
+}
+
+func deviceArrived(d device) {
+	handles := disconnectedSessionsFor(d)
+
+	publishDeviceEvent(deviceEvent{
+		Type:    deviceEventArrived,
+		Time:    time.Now(),
+		Device:  d,
+		Serial:  serialFromDeviceId(d.ID),
+		Handles: handles,
+	})
+
+	// Cameras that were open when they dropped off get reopened under the
+	// same handle
+	if len(handles) > 0 {
+		reconnectDevice(d)
+	}
+}
+
+// enumerateDevices returns every device Windows currently recognizes as a camera
+func enumerateDevices(ctx context.Context) ([]device, error) {
+	count, err := systemWorker.call(ctx, procGetPortableDeviceCount)
+
+	if err != nil {
+		return nil, err
+	}
+
+	deviceCount := int(count)
+	var devices []device
+
+	for index := 0; index < deviceCount; index++ {
+		var d device
+		b := winstruct.NewByteBuffer(&d)
+
+		if _, err = systemWorker.call(ctx, procGetPortableDeviceInfo, index, getPointerToSlice(b.Bytes())); err != nil {
+			return nil, err
+		}
+
+		winstruct.Unmarshal(b, &d)
+		devices = append(devices, d)
+	}
+
+	return devices, nil
+}
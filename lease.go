@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultLeaseTTL = time.Minute
+	minLeaseTTL     = 5 * time.Second
+	maxLeaseTTL     = time.Hour
+
+	// leaseHeader carries the lease ID on requests that change the camera
+	leaseHeader = "X-Lease-Id"
+)
+
+// lease gives one client exclusive control of a camera until it expires.
+// Everyone can see who holds it, only the holder knows the ID
+type lease struct {
+	ID       string    `json:"id,omitempty"`
+	Holder   string    `json:"holder"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+	TTL      string    `json:"ttl"`
+
+	timer *time.Timer
+}
+
+type leaseRequest struct {
+	// Holder names the client when there is no API token to name it
+	Holder string `json:"holder"`
+	TTL    string `json:"ttl"`
+}
+
+var (
+	leasesLock sync.Mutex
+	leases     = map[uintptr]*lease{}
+)
+
+// getLease shows who holds the camera, or 404 if nobody does
+func getLease(c *gin.Context) {
+	hCamera := getCameraHandleFromPath(c)
+
+	l := currentLease(hCamera)
+
+	if l == nil {
+		c.IndentedJSON(http.StatusNotFound, errorResponse{Error: "camera is not leased"})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, l)
+}
+
+// postLease takes a lease on the camera, or renews it when the request comes
+// with the current lease ID. The response is the only place the ID is given
+func postLease(c *gin.Context) {
+	hCamera := getCameraHandleFromPath(c)
+
+	in := leaseRequest{}
+
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&in); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	ttl := defaultLeaseTTL
+
+	if in.TTL != "" {
+		var err error
+
+		if ttl, err = parseSeconds("ttl", in.TTL); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	if ttl < minLeaseTTL || ttl > maxLeaseTTL {
+		c.IndentedJSON(http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("ttl must be between %s and %s", minLeaseTTL, maxLeaseTTL)})
+		return
+	}
+
+	holder := getIdentity(c).Name
+
+	// Without authentication everyone is anonymous, so let them say who they are
+	if in.Holder != "" && (holder == "" || len(config.Auth.Tokens) == 0) {
+		holder = in.Holder
+	}
+
+	l, err := acquireLease(hCamera, c.GetHeader(leaseHeader), holder, ttl)
+
+	if err != nil {
+		c.IndentedJSON(http.StatusConflict, leaseConflict(err, l))
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, l)
+}
+
+// deleteLease gives the camera back. Admins can break someone else's lease
+func deleteLease(c *gin.Context) {
+	hCamera := getCameraHandleFromPath(c)
+
+	leasesLock.Lock()
+	l := activeLease(hCamera)
+
+	if l == nil {
+		leasesLock.Unlock()
+		c.IndentedJSON(http.StatusNotFound, errorResponse{Error: "camera is not leased"})
+		return
+	}
+
+	if !l.heldBy(c.GetHeader(leaseHeader)) && getIdentity(c).role < roleAdmin {
+		leasesLock.Unlock()
+		c.IndentedJSON(http.StatusForbidden, leaseConflict(fmt.Errorf("camera is leased by %s", l.Holder), l.public()))
+		return
+	}
+
+	l.timer.Stop()
+	delete(leases, hCamera)
+	leasesLock.Unlock()
+
+	publishCameraEvent(hCamera, cameraEvent{Type: cameraEventLease, Time: time.Now()})
+
+	c.IndentedJSON(http.StatusOK, emptyResponse{})
+}
+
+// RequireLease lets a request that changes the camera through only if nobody
+// holds a lease on it, or the request carries the lease ID
+func RequireLease() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hCamera := getCameraHandleFromPath(c)
+
+		if l, ok := leaseAllows(hCamera, c.GetHeader(leaseHeader)); !ok {
+			c.AbortWithStatusJSON(http.StatusLocked, leaseConflict(fmt.Errorf("camera is leased by %s until %s", l.Holder, l.Expires.Format(time.RFC3339)), l))
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// leaseAllows checks a lease ID against the camera, returning the current
+// lease (without its ID) if it doesn't match
+func leaseAllows(hCamera uintptr, id string) (lease, bool) {
+	leasesLock.Lock()
+	defer leasesLock.Unlock()
+
+	l := activeLease(hCamera)
+
+	if l == nil || l.heldBy(id) {
+		return lease{}, true
+	}
+
+	return l.public(), false
+}
+
+func acquireLease(hCamera uintptr, id string, holder string, ttl time.Duration) (lease, error) {
+	leasesLock.Lock()
+	defer leasesLock.Unlock()
+
+	now := time.Now()
+	l := activeLease(hCamera)
+
+	switch {
+	case l != nil && !l.heldBy(id):
+		return l.public(), fmt.Errorf("camera is leased by %s", l.Holder)
+	case l != nil:
+		l.timer.Stop()
+	default:
+		l = &lease{ID: newLeaseID(), Holder: holder, Acquired: now}
+		leases[hCamera] = l
+	}
+
+	l.TTL = ttl.String()
+	l.Expires = now.Add(ttl)
+
+	// Expiry is also checked whenever the lease is looked at, the timer is
+	// just so watchers hear about it
+	expired := l
+	l.timer = time.AfterFunc(ttl, func() {
+		leasesLock.Lock()
+		current := leases[hCamera] == expired && !time.Now().Before(expired.Expires)
+
+		if current {
+			delete(leases, hCamera)
+		}
+		leasesLock.Unlock()
+
+		if current {
+			publishCameraEvent(hCamera, cameraEvent{Type: cameraEventLease, Time: time.Now()})
+		}
+	})
+
+	result := *l
+	result.timer = nil
+
+	publishCameraEvent(hCamera, cameraEvent{Type: cameraEventLease, Time: now, Lease: l.publicPtr()})
+
+	return result, nil
+}
+
+// forgetLease is used when a camera is closed
+func forgetLease(hCamera uintptr) {
+	leasesLock.Lock()
+	defer leasesLock.Unlock()
+
+	if l, ok := leases[hCamera]; ok {
+		l.timer.Stop()
+		delete(leases, hCamera)
+	}
+}
+
+func currentLease(hCamera uintptr) *lease {
+	leasesLock.Lock()
+	defer leasesLock.Unlock()
+
+	if l := activeLease(hCamera); l != nil {
+		return l.publicPtr()
+	}
+
+	return nil
+}
+
+// activeLease returns the unexpired lease on a camera, must be called with
+// leasesLock held
+func activeLease(hCamera uintptr) *lease {
+	l, ok := leases[hCamera]
+
+	if !ok {
+		return nil
+	}
+
+	if !time.Now().Before(l.Expires) {
+		l.timer.Stop()
+		delete(leases, hCamera)
+		return nil
+	}
+
+	return l
+}
+
+func (l *lease) heldBy(id string) bool {
+	return id != "" && subtle.ConstantTimeCompare([]byte(id), []byte(l.ID)) == 1
+}
+
+// public is the lease as shown to everyone other than the holder
+func (l *lease) public() lease {
+	return lease{Holder: l.Holder, Acquired: l.Acquired, Expires: l.Expires, TTL: l.TTL}
+}
+
+func (l *lease) publicPtr() *lease {
+	p := l.public()
+	return &p
+}
+
+type leaseConflictResponse struct {
+	Error string `json:"error"`
+	Lease *lease `json:"lease,omitempty"`
+}
+
+func leaseConflict(err error, l lease) leaseConflictResponse {
+	return leaseConflictResponse{Error: err.Error(), Lease: &l}
+}
+
+func newLeaseID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes, at most once per handshake
+const certCheckInterval = 10 * time.Second
+
+// selfSignedValidity is how long a generated certificate lasts
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// tlsSettings turns on HTTPS for the TCP listeners. The unix socket is always
+// plain HTTP, it is only reachable from the machine itself
+type tlsSettings struct {
+	Enabled  bool   `yaml:"enabled"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// SelfSigned generates a certificate (and key) if the files don't exist
+	SelfSigned bool `yaml:"selfSigned"`
+	// Hosts are the names and addresses a generated certificate is for,
+	// localhost and this machine's name are always included
+	Hosts []string `yaml:"hosts"`
+}
+
+// certReloader serves the certificate from disk, picking up a replacement
+// without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lock        sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+// serve listens on every configured address (and the unix socket if there is
+// one) with a single server, returning when any of them fails
+func serve(srv *http.Server, cfg serverConfig) error {
+	listeners, err := openListeners(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, len(listeners))
+
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			err := srv.Serve(l)
+
+			if !errors.Is(err, http.ErrServerClosed) {
+				err = fmt.Errorf("%s: %w", l.Addr(), err)
+			}
+
+			errs <- err
+		}(l)
+	}
+
+	return <-errs
+}
+
+func openListeners(cfg serverConfig) ([]net.Listener, error) {
+	var listeners []net.Listener
+	var tlsConfig *tls.Config
+
+	closeAll := func() {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+	}
+
+	if cfg.TLS.Enabled {
+		reloader, err := newCertReloader(cfg.TLS)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.getCertificate,
+			// Websockets need http/1.1
+			NextProtos: []string{"http/1.1"},
+		}
+	}
+
+	for _, addr := range cfg.Listen {
+		l, err := net.Listen("tcp", addr)
+
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		scheme := "http"
+
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+			scheme = "https"
+		}
+
+		logInfof("Listening on %s://%s", scheme, addr)
+		listeners = append(listeners, l)
+	}
+
+	if cfg.UnixSocket != "" {
+		// A socket left behind by a previous run would stop us listening
+		if err := os.Remove(cfg.UnixSocket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			closeAll()
+			return nil, err
+		}
+
+		l, err := net.Listen("unix", cfg.UnixSocket)
+
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		// Only this user (and their group) should be able to drive the camera
+		_ = os.Chmod(cfg.UnixSocket, 0o660)
+
+		logInfof("Listening on unix socket %s", cfg.UnixSocket)
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+func newCertReloader(cfg tlsSettings) (*certReloader, error) {
+	certFile, keyFile := cfg.CertFile, cfg.KeyFile
+
+	// Self signed certificates live in the settings directory unless told
+	// otherwise
+	if certFile == "" && keyFile == "" && cfg.SelfSigned {
+		var err error
+
+		if certFile, err = settingsPath("cert.pem"); err != nil {
+			return nil, err
+		}
+
+		if keyFile, err = settingsPath("key.pem"); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.SelfSigned {
+		if _, err := os.Stat(certFile); errors.Is(err, os.ErrNotExist) {
+			if err := generateSelfSigned(certFile, keyFile, cfg.Hosts); err != nil {
+				return nil, fmt.Errorf("unable to generate a self-signed certificate: %w", err)
+			}
+
+			logWarnf("Generated a self-signed certificate in %s, clients will need to trust it", certFile)
+		}
+	}
+
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	if _, err := r.getCertificate(nil); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// getCertificate returns the current certificate, reloading it if either
+// file has changed. A certificate that fails to load is ignored and the
+// previous one kept, so a half copied file doesn't take the server down
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.cert != nil && time.Since(r.lastCheck) < certCheckInterval {
+		return r.cert, nil
+	}
+
+	r.lastCheck = time.Now()
+
+	certInfo, certErr := os.Stat(r.certFile)
+	keyInfo, keyErr := os.Stat(r.keyFile)
+
+	if err := errors.Join(certErr, keyErr); err != nil {
+		if r.cert != nil {
+			logWarnf("Unable to check certificate: %s", err)
+			return r.cert, nil
+		}
+
+		return nil, err
+	}
+
+	if r.cert != nil && certInfo.ModTime().Equal(r.certModTime) && keyInfo.ModTime().Equal(r.keyModTime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+
+	if err != nil {
+		if r.cert != nil {
+			logWarnf("Keeping the previous certificate, unable to load the new one: %s", err)
+			return r.cert, nil
+		}
+
+		return nil, err
+	}
+
+	if r.cert != nil {
+		logInfof("Reloaded certificate from %s", r.certFile)
+	}
+
+	r.cert = &cert
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+
+	return r.cert, nil
+}
+
+// generateSelfSigned writes a new key and a certificate for it covering
+// localhost, this machine and any extra hosts
+func generateSelfSigned(certFile string, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"SonyCamGoAPI"}, CommonName: "SonyCamGoAPI"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	names := append([]string{"localhost", "127.0.0.1", "::1"}, hosts...)
+
+	if hostname, err := os.Hostname(); err == nil {
+		names = append(names, hostname)
+	}
+
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			return err
+		}
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
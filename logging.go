@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	logLevelDebug = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+var logLevels = map[string]int{
+	"debug": logLevelDebug,
+	"info":  logLevelInfo,
+	"warn":  logLevelWarn,
+	"error": logLevelError,
+}
+
+var logLevelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// logLevel is the least severe level that gets written
+var logLevel = logLevelInfo
+
+func logf(level int, format string, args ...any) {
+	if level < logLevel {
+		return
+	}
+
+	fmt.Printf("%s [%s] %s\n", time.Now().Format("2006/01/02 - 15:04:05"), logLevelNames[level], fmt.Sprintf(format, args...))
+}
+
+func logDebugf(format string, args ...any) { logf(logLevelDebug, format, args...) }
+func logInfof(format string, args ...any)  { logf(logLevelInfo, format, args...) }
+func logWarnf(format string, args ...any)  { logf(logLevelWarn, format, args...) }
+func logErrorf(format string, args ...any) { logf(logLevelError, format, args...) }
+
+// formatRequestLog is gin's usual request log line, with any access token in
+// the query string blanked out
+func formatRequestLog(param gin.LogFormatterParams) string {
+	if u, err := url.Parse(param.Path); err == nil && u.Query().Has("access_token") {
+		query := u.Query()
+		query.Set("access_token", "REDACTED")
+		u.RawQuery = query.Encode()
+		param.Path = u.String()
+	}
+
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		param.Path,
+		param.ErrorMessage,
+	)
+}
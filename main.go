@@ -3,14 +3,20 @@ package main
 import (
 	"Sony/Web/winstruct"
 	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/go-ole/go-ole"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -28,16 +34,27 @@ var (
 	procGetPropertyList        = cameraDLL.NewProc("GetPropertyList")
 	procGetAllPropertyValues   = cameraDLL.NewProc("GetAllPropertyValues")
 	procGetPreviewImage        = cameraDLL.NewProc("GetPreviewImage")
+	procSetPropertyValue       = cameraDLL.NewProc("SetPropertyValue")
+	procStartCapture           = cameraDLL.NewProc("StartCapture")
+	procGetCaptureStatus       = cameraDLL.NewProc("GetCaptureStatus")
+	procGetImage               = cameraDLL.NewProc("GetImage")
+	procCancelCapture          = cameraDLL.NewProc("CancelCapture")
 )
 
 type emptyResponse struct{}
 
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
 type cameraHandle struct {
 	Handle uint64 `json:"handle"`
+	Alias  string `json:"alias,omitempty"`
 }
 
 type openJson struct {
-	ID string `json:"id"`
+	ID    string `json:"id"`
+	Alias string `json:"alias"`
 }
 
 // device contains basic info about an enumerated camera
@@ -78,6 +95,10 @@ type CameraInfo struct {
 	Size   imageMeta  `json:"size"`
 	Pixel  pixelMeta  `json:"pixel"`
 	Device deviceMeta `json:"device"`
+	// FromDatabase is set when the camera reported zeros and some values came
+	// from the model database instead, DatabaseFields lists which
+	FromDatabase   bool     `json:"fromDatabase"`
+	DatabaseFields []string `json:"databaseFields,omitempty"`
 }
 
 type deviceInfo struct {
@@ -161,82 +182,155 @@ type imageInfo struct {
 	Duration float64 `json:"duration" windows:"double"`
 }
 
-func CameraDLL() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// Because each request can be on a different thread, we need to initialize com
-		// but we can't uninitialize at the end or code using com will lose all its refs
-		// so if initialize "fails" it (in general) means it's already been done on this
-		// thread, so we uninitialize to prevent runaway ref counts
-		//		fmt.Printf("Initializing COM\n")
-		err := ole.CoInitialize(0)
+func main() {
+	// Tokens are stored hashed, this prints the hash to put in the config
+	if len(os.Args) == 3 && os.Args[1] == "hash-token" {
+		fmt.Println(hashToken(os.Args[2]))
+		return
+	}
 
-		if err != nil {
-			ole.CoUninitialize()
-		}
+	cfg, printConfig, err := loadConfig(os.Args[1:])
 
-		c.Next()
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
 	}
-}
 
-func CORSMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+	if printConfig {
+		_ = yaml.NewEncoder(os.Stdout).Encode(cfg)
+		return
+	}
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
+	cfg.apply()
+
+	// Every DLL call is made on a worker thread that has COM initialized, see
+	// dllWorker
+	systemWorker = startDLLWorker("system")
+	defer systemWorker.stop()
 
-		c.Next()
+	// LoadLibrary only happens on the first call otherwise, which is too late
+	// to find out the DLL is missing
+	if dll := checkDLL(context.Background()); !dll.Loaded {
+		logErrorf("Unable to load %s: %s", dll.Name, dll.Error)
+	} else {
+		logInfof("Loaded %s", dll.Path)
+
+		for _, p := range dll.Procs {
+			if !p.Resolved {
+				logWarnf("%s is missing from %s: %s", p.Name, dll.Name, p.Error)
+			}
+		}
 	}
-}
 
-func main() {
-	fmt.Printf("Initializing COM\n")
-	err := ole.CoInitialize(0)
+	go watchDevices()
 
-	if err != nil {
-		fmt.Printf("Got error calling coinitialize: %s", err)
+	if logLevel == logLevelDebug {
+		gin.SetMode(gin.DebugMode)
+	} else {
+		gin.SetMode(gin.ReleaseMode)
 	}
 
-	router := gin.Default()
-	router.Use(CORSMiddleware())
-	router.Use(CameraDLL())
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.Use(Metrics())
 
-	router.GET("/devices", getDevices)
-	router.GET("/cameras/:handle/info", getDeviceInfo)
-	router.POST("/cameras", openCamera)
-	router.DELETE("/cameras/:handle", closeCamera)
-	router.GET("/cameras/:handle/propertyDescriptors", getCameraPropertyDescriptors)
-	router.GET("/cameras/:handle/properties", getCameraProperties)
-	router.GET("/cameras/:handle/preview", getPreviewImage)
+	// Every request is logged at info, quieter levels only hear about problems
+	if logLevel <= logLevelInfo {
+		router.Use(gin.LoggerWithFormatter(formatRequestLog))
+	}
+
+	router.Use(CORSMiddleware(router, cfg.CORS))
+
+	// Health checks come from load balancers and the like, which won't have a
+	// token
+	router.GET("/healthz", getHealth)
+	router.GET("/readyz", getReady)
+
+	viewer := RequireRole(roleViewer)
+	operator := RequireRole(roleOperator)
+	admin := RequireRole(roleAdmin)
+	leased := RequireLease()
+
+	api := router.Group("", Authenticate(cfg.Auth))
+	api.GET("/config", admin, getConfig)
+	api.GET("/diagnostics", viewer, getDiagnostics)
+	api.GET("/metrics", viewer, getMetrics())
+	api.GET("/devices", viewer, getDevices)
+	api.GET("/devices/events", viewer, getDeviceEvents)
+	api.GET("/profiles", viewer, getProfiles)
+	api.GET("/profiles/:model", viewer, getProfile)
+	api.PUT("/profiles/:model", admin, putProfile)
+	api.DELETE("/profiles/:model", admin, deleteProfile)
+	api.GET("/cameras", viewer, getSessions)
+	api.POST("/cameras", admin, openCamera)
+
+	camera := api.Group("/cameras/:handle", CameraSession())
+	camera.GET("", viewer, getSession)
+	camera.DELETE("", admin, leased, closeCamera)
+	camera.GET("/info", viewer, getDeviceInfo)
+	camera.GET("/capabilities", viewer, getCapabilities)
+	camera.PUT("/profile", admin, leased, putCameraProfile)
+	camera.GET("/lease", viewer, getLease)
+	camera.POST("/lease", operator, postLease)
+	camera.DELETE("/lease", operator, deleteLease)
+	camera.GET("/propertyDescriptors", viewer, getCameraPropertyDescriptors)
+	camera.GET("/properties", viewer, getCameraProperties)
+	camera.GET("/preview", viewer, getPreviewImage)
+	camera.GET("/liveview.mjpeg", viewer, getLiveView)
+	camera.GET("/ws", viewer, getWebSocket)
+	camera.GET("/events", viewer, getEvents)
+	camera.GET("/exposure", viewer, getExposure)
+	camera.PUT("/exposure", operator, leased, putExposure)
+	camera.POST("/captures", operator, leased, startCapture)
+	camera.GET("/captures", viewer, getCaptures)
+	camera.GET("/captures/:id", viewer, getCapture)
+	camera.GET("/captures/:id/image", viewer, getCaptureImage)
+	camera.DELETE("/captures/:id", operator, leased, deleteCapture)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Handler: router, ReadHeaderTimeout: 30 * time.Second}
+	errs := make(chan error, 1)
+
+	go func() { errs <- serve(srv, cfg) }()
+
+	select {
+	case err := <-errs:
+		logErrorf("%s", err)
+		shutdown(srv, cfg.ShutdownTimeout).log()
+		systemWorker.stop()
+		os.Exit(1)
+	case <-ctx.Done():
+	}
 
-	_ = router.Run("localhost:8080")
+	// A second Ctrl+C stops us straight away
+	stop()
 
-	ole.CoUninitialize()
+	logInfof("Shutting down, press Ctrl+C again to stop immediately")
+	shutdown(srv, cfg.ShutdownTimeout).log()
 }
 
 // getDevices returns a list of devices that are recognized by Windows as cameras
 func getDevices(c *gin.Context) {
-	// Try to call DLL to get list
-	count, _, _ := procGetPortableDeviceCount.Call()
-	deviceCount := int(count)
-	var devices []device
+	devices, err := enumerateDevices(c.Request.Context())
 
-	for index := 0; index < deviceCount; index++ {
-		var d device
-		b := winstruct.NewByteBuffer(&d)
-		_, _, _ = procGetPortableDeviceInfo.Call(uintptr(index), getPointerToSlice(b.Bytes()))
-		winstruct.Unmarshal(b, &d)
-		devices = append(devices, d)
+	if err != nil {
+		abortWithCameraError(c, err)
+		return
 	}
 
 	c.IndentedJSON(http.StatusOK, devices)
 }
 
-func getPointerToSlice(buffer []byte) uintptr {
+// getPointerToSlice returns the buffer as an unsafe.Pointer rather than a
+// uintptr, so that while a DLL call is using it the buffer can't be freed,
+// even if the caller has timed out and gone. See dllArgs
+func getPointerToSlice(buffer []byte) unsafe.Pointer {
 	// I wanted to use unsafe.SliceData, but it has a funky type that was getting in the way
 	// the "&buffer[:1][0]" is directly from its documentation:
 	// 		SliceData returns a pointer to the underlying array of the argument
@@ -246,12 +340,14 @@ func getPointerToSlice(buffer []byte) uintptr {
 	//   		- Otherwise, SliceData returns a non-nil pointer to an
 	//     		  unspecified memory address.
 
-	return uintptr(unsafe.Pointer(&buffer[:1][0]))
+	return unsafe.Pointer(&buffer[:1][0])
 }
 
+// getCameraHandleFromPath returns our handle for the camera in the path, which
+// CameraSession has already checked. callCamera maps it to the DLL handle
 func getCameraHandleFromPath(c *gin.Context) uintptr {
-	var hC, _ = strconv.Atoi(c.Param("handle"))
-	return uintptr(hC)
+	s := c.MustGet(sessionKey).(*session)
+	return uintptr(s.Handle)
 }
 
 func cropModeAsString(cropMode uint32) string {
@@ -323,15 +419,14 @@ func getDeviceInfo(c *gin.Context) {
 	// Each contains some different data - and eventually I'd like to combine them
 	hCamera := getCameraHandleFromPath(c)
 
-	dInfo := deviceInfo{Version: 1}
-	buffer := winstruct.Marshal(&dInfo)
-	_, _, _ = procGetDeviceInfo.Call(hCamera, getPointerToSlice(buffer.Bytes()))
-	winstruct.Unmarshal(buffer, &dInfo)
+	dInfo, cInfo, err := fetchCameraInfo(c.Request.Context(), hCamera)
 
-	cInfo := camera{}
-	buffer = winstruct.NewByteBuffer(&cInfo)
-	_, _, _ = procGetCameraInfo.Call(hCamera, getPointerToSlice(buffer.Bytes()))
-	winstruct.Unmarshal(buffer, &cInfo)
+	if err != nil {
+		abortWithCameraError(c, err)
+		return
+	}
+
+	filled := fillFromModelDatabase(&dInfo, &cInfo)
 
 	// Construct resultant output
 	info := CameraInfo{
@@ -357,93 +452,271 @@ func getDeviceInfo(c *gin.Context) {
 			SensorName:    dInfo.SensorName,
 			DeviceName:    dInfo.DeviceName,
 		},
+		FromDatabase:   len(filled) > 0,
+		DatabaseFields: filled,
 	}
 
 	c.IndentedJSON(http.StatusOK, info)
 }
 
+// fetchCameraInfo reads both the DeviceInfo and CameraInfo structures
+func fetchCameraInfo(ctx context.Context, hCamera uintptr) (deviceInfo, camera, error) {
+	dInfo := deviceInfo{Version: 1}
+	buffer := winstruct.Marshal(&dInfo)
+
+	if _, err := callCamera(ctx, hCamera, procGetDeviceInfo, getPointerToSlice(buffer.Bytes())); err != nil {
+		return dInfo, camera{}, err
+	}
+
+	winstruct.Unmarshal(buffer, &dInfo)
+
+	cInfo := camera{}
+	buffer = winstruct.NewByteBuffer(&cInfo)
+
+	if _, err := callCamera(ctx, hCamera, procGetCameraInfo, getPointerToSlice(buffer.Bytes())); err != nil {
+		return dInfo, cInfo, err
+	}
+
+	winstruct.Unmarshal(buffer, &cInfo)
+
+	return dInfo, cInfo, nil
+}
+
 func openCamera(c *gin.Context) {
 	in := openJson{}
 	_ = c.ShouldBindJSON(&in)
-	var hCamera uintptr
 
-	sptr, _ := syscall.UTF16PtrFromString(in.ID)
-	hCamera, _, _ = procOpenDeviceEx.Call(uintptr(unsafe.Pointer(sptr)), 0)
+	if _, err := strconv.ParseUint(in.Alias, 10, 64); err == nil {
+		c.IndentedJSON(http.StatusBadRequest, errorResponse{Error: "alias cannot be a number"})
+		return
+	}
+
+	// The camera gets its own thread for DLL calls, and the handle needs to be
+	// opened on it
+	worker := startDLLWorker(in.ID)
+	hCamera, err := openDevice(c.Request.Context(), worker, in.ID)
+
+	if err != nil {
+		worker.stop()
+		abortWithCameraError(c, err)
+		return
+	}
+
+	if hCamera == 0 {
+		worker.stop()
+		c.IndentedJSON(http.StatusOK, cameraHandle{})
+		return
+	}
 
-	result := cameraHandle{Handle: uint64(hCamera)}
+	// Models the DLL doesn't know report zeros until they have been learnt
+	if err := applyStoredProfile(c.Request.Context(), worker, hCamera); err != nil {
+		logWarnf("Unable to apply camera profile for %s: %s", in.ID, err)
+	}
+
+	// Clients get our own handle rather than the DLL one, so it can stay the
+	// same if the camera has to be reopened
+	info, err := addSession(worker, hCamera, in.ID, in.Alias)
+
+	if err != nil {
+		_, _ = worker.call(c.Request.Context(), procCloseDevice, hCamera)
+		worker.stop()
+		c.IndentedJSON(http.StatusConflict, errorResponse{Error: err.Error()})
+		return
+	}
+
+	result := cameraHandle{Handle: info.Handle, Alias: info.Alias}
 	c.IndentedJSON(http.StatusOK, result)
 }
 
 func closeCamera(c *gin.Context) {
 	hCamera := getCameraHandleFromPath(c)
 
-	_, _, _ = procCloseDevice.Call(hCamera)
+	_ = closeSession(c.Request.Context(), hCamera)
 
 	c.IndentedJSON(http.StatusOK, emptyResponse{})
 }
 
+// closeSession tidies up everything attached to a camera and closes it,
+// returning what was cleaned up
+func closeSession(ctx context.Context, hCamera uintptr) closeReport {
+	report := closeReport{Handle: uint64(hCamera)}
+
+	// Anything still exposing would otherwise leave the camera stuck mid-capture
+	report.CapturesAborted = abortCaptures(ctx, hCamera)
+	report.StreamsEnded = stopPreview(hCamera) + stopCameraEvents(hCamera)
+	forgetCaptures(hCamera)
+	forgetPropertyHistory(hCamera)
+	forgetPropertyDescriptors(hCamera)
+	forgetLease(hCamera)
+
+	// Even if this fails (or times out) the session goes, there is nothing more
+	// we can do with it
+	if _, err := callCamera(ctx, hCamera, procCloseDevice); err != nil {
+		report.Error = err.Error()
+	}
+
+	removeSession(uint64(hCamera))
+
+	return report
+}
+
+// getCameraPropertyDescriptors returns the cached descriptors, reading them
+// from the camera the first time. Responses carry an ETag so clients can send
+// If-None-Match and get a 304 back, and ?refresh=true rereads the camera
 func getCameraPropertyDescriptors(c *gin.Context) {
 	hCamera := getCameraHandleFromPath(c)
 
+	if refresh, _ := strconv.ParseBool(c.Query("refresh")); refresh {
+		invalidatePropertyDescriptors(hCamera)
+	}
+
+	cached, err := cachedPropertyDescriptors(c.Request.Context(), hCamera)
+
+	if err != nil {
+		abortWithCameraError(c, err)
+		return
+	}
+
+	c.Header("ETag", cached.ETag)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Last-Modified", cached.Fetched.UTC().Format(http.TimeFormat))
+
+	if etagMatches(c.GetHeader("If-None-Match"), cached.ETag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, cached.Descriptors)
+}
+
+// errorRetry is what GetPropertyList returns when asked for the count, it
+// isn't a failure
+const errorRetry = 1237 // windows.ERROR_RETRY
+
+// fetchPropertyIds returns the ids of every property the camera exposes
+func fetchPropertyIds(ctx context.Context, hCamera uintptr) ([]uint, error) {
 	count := 0
 
-	hr, _, _ := procGetPropertyList.Call(hCamera, 0, uintptr(unsafe.Pointer(&count)))
-	var descriptors []propertyDescriptor
+	hr, err := callCamera(ctx, hCamera, procGetPropertyList, 0, unsafe.Pointer(&count))
+	var ids []uint
 
-	if hr == 1237 { //windows.ERROR_RETRY
+	if err != nil {
+		return nil, err
+	}
+
+	if hr == errorRetry {
 		b := make([]byte, count*4)
 
-		hr, _, _ = procGetPropertyList.Call(hCamera, getPointerToSlice(b), uintptr(unsafe.Pointer(&count)))
+		if _, err = callCamera(ctx, hCamera, procGetPropertyList, getPointerToSlice(b), unsafe.Pointer(&count)); err != nil {
+			return nil, err
+		}
 
 		for i := 0; i < count; i++ {
 			offs := i * 4
 			id := uint(b[offs]) + uint(b[offs+1])<<8 + uint(b[offs+2])<<16 + uint(b[offs+3])<<24
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
 
-			// Get Property Descriptor
-			pd := propertyDescriptor{}
-			buffer := winstruct.NewByteBuffer(&pd)
-			hr, _, _ = procGetPropertyDescriptor.Call(hCamera, uintptr(id), getPointerToSlice(buffer.Bytes()))
-			winstruct.Unmarshal(buffer, &pd)
-			pd.Type = typeIdToString(pd.TypeId)
+// fetchPropertyDescriptor reads a single property descriptor, including its
+// enum options (if it has any)
+func fetchPropertyDescriptor(ctx context.Context, hCamera uintptr, id uint) (propertyDescriptor, error) {
+	pd := propertyDescriptor{}
+	buffer := winstruct.NewByteBuffer(&pd)
 
-			// Get options (if this is an enum)
-			if pd.ValueCount > 0 {
-				var option propertyValueOption
+	if _, err := callCamera(ctx, hCamera, procGetPropertyDescriptor, id, getPointerToSlice(buffer.Bytes())); err != nil {
+		return pd, err
+	}
+
+	winstruct.Unmarshal(buffer, &pd)
+	pd.Type = typeIdToString(pd.TypeId)
 
-				for j := uint(0); j < pd.ValueCount; j++ {
-					optionBuffer := winstruct.NewByteBuffer(&option)
-					_, _, _ = procGetPropertyValueOption.Call(hCamera, uintptr(id), getPointerToSlice(optionBuffer.Bytes()), uintptr(j))
+	// Get options (if this is an enum)
+	if pd.ValueCount > 0 {
+		var option propertyValueOption
 
-					winstruct.Unmarshal(optionBuffer, &option)
-					pd.Values = append(pd.Values, option)
-				}
+		for j := uint(0); j < pd.ValueCount; j++ {
+			optionBuffer := winstruct.NewByteBuffer(&option)
+
+			if _, err := callCamera(ctx, hCamera, procGetPropertyValueOption, id, getPointerToSlice(optionBuffer.Bytes()), j); err != nil {
+				return pd, err
 			}
 
-			descriptors = append(descriptors, pd)
+			winstruct.Unmarshal(optionBuffer, &option)
+			pd.Values = append(pd.Values, option)
 		}
 	}
 
-	c.IndentedJSON(http.StatusOK, descriptors)
+	return pd, nil
 }
 
+// getCameraProperties returns every property value, along with the version of
+// the snapshot in the X-Property-Version header. Passing ?since=<version>
+// returns only the properties that changed after that version, and adding
+// &wait=30s blocks until there is at least one change (or the wait expires)
 func getCameraProperties(c *gin.Context) {
 	hCamera := getCameraHandleFromPath(c)
 
+	properties, err := fetchPropertyValues(c.Request.Context(), hCamera)
+
+	if err != nil {
+		abortWithCameraError(c, err)
+		return
+	}
+
+	if len(properties) == 0 {
+		panic(fmt.Sprintf("Unable to get properties - seems there are none!"))
+	}
+
+	version := recordPropertyValues(hCamera, properties)
+
+	if since, ok := c.GetQuery("since"); ok {
+		sinceVersion, err := strconv.ParseUint(since, 10, 64)
+
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, errorResponse{Error: "since must be a property version number"})
+			return
+		}
+
+		wait, err := parseWait(c.Query("wait"))
+
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+
+		version, properties = waitForPropertyChanges(c.Request.Context(), hCamera, sinceVersion, wait)
+	}
+
+	c.Header("X-Property-Version", strconv.FormatUint(version, 10))
+	c.IndentedJSON(http.StatusOK, properties)
+}
+
+// fetchPropertyValues reads the current value of every property on the camera
+func fetchPropertyValues(ctx context.Context, hCamera uintptr) ([]propertyValue, error) {
 	// Driver will tend to return cached info to keep fast performance
-	//	_, _, _ = procRefreshPropertyList.Call(hCamera)
+	//	_, _ = callCamera(ctx, hCamera, procRefreshPropertyList)
 
 	count := 0
-	_, _, _ = procGetAllPropertyValues.Call(hCamera, 0, uintptr(unsafe.Pointer(&count)))
+
+	if _, err := callCamera(ctx, hCamera, procGetAllPropertyValues, 0, unsafe.Pointer(&count)); err != nil {
+		return nil, err
+	}
 
 	if count == 0 {
-		panic(fmt.Sprintf("Unable to get properties - seems there are none!"))
+		return nil, nil
 	}
 
 	neededSize := winstruct.Size(&propertyValue{})
 	b := make([]byte, neededSize*count)
 	var properties []propertyValue
 
-	_, _, _ = procGetAllPropertyValues.Call(hCamera, getPointerToSlice(b), uintptr(unsafe.Pointer(&count)))
+	if _, err := callCamera(ctx, hCamera, procGetAllPropertyValues, getPointerToSlice(b), unsafe.Pointer(&count)); err != nil {
+		return nil, err
+	}
 
 	buffer := bytes.NewBuffer(b)
 
@@ -454,18 +727,5 @@ func getCameraProperties(c *gin.Context) {
 		properties = append(properties, property)
 	}
 
-	c.IndentedJSON(http.StatusOK, properties)
-}
-
-func getPreviewImage(c *gin.Context) {
-	hCamera := getCameraHandleFromPath(c)
-
-	info := imageInfo{ImageMode: 3} // JPEG
-	buffer := winstruct.Marshal(&info)
-
-	_, _, _ = procGetPreviewImage.Call(hCamera, getPointerToSlice(buffer.Bytes()))
-
-	winstruct.Unmarshal(buffer, &info)
-
-	c.IndentedJSON(http.StatusOK, info)
+	return properties, nil
 }
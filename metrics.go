@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry is ours rather than the global one, so only what we
+// register is exported
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	dllCallDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name: "sonycam_dll_call_duration_seconds",
+		Help: "Time spent in each DLL function, including calls that ran on after timing out.",
+		// From a quick property read up to downloading a big RAW file
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"proc"})
+
+	dllCallFailures = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "sonycam_dll_call_failures_total",
+		Help: "DLL calls that failed, by the error code returned or timeout, canceled or closed.",
+	}, []string{"proc", "code"})
+
+	httpRequestDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sonycam_http_request_duration_seconds",
+		Help:    "Time taken to answer HTTP requests, streams are measured until they end.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	previewFramesServed = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "sonycam_preview_frames_served_total",
+		Help: "Live view frames sent to clients, by how they were sent.",
+	}, []string{"transport"})
+
+	previewFramesDropped = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "sonycam_preview_frames_dropped_total",
+		Help: "Live view frames lost, either not fetched from the camera or not written to a client.",
+	}, []string{"reason"})
+
+	bytesSent = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "sonycam_bytes_sent_total",
+		Help: "Image data sent to clients, by preview or capture.",
+	}, []string{"kind"})
+
+	captureOutcomes = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "sonycam_captures_total",
+		Help: "Captures that have finished, by outcome.",
+	}, []string{"outcome"})
+
+	_ = promauto.With(metricsRegistry).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "sonycam_open_handles",
+		Help: "Cameras currently open.",
+	}, func() float64 { return float64(len(listSessions())) })
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// getMetrics serves everything in metricsRegistry in the Prometheus format
+func getMetrics() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// Metrics times every request by the route that handled it, so that
+// /cameras/1/info and /cameras/2/info are counted together
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		started := time.Now()
+
+		c.Next()
+
+		route := c.FullPath()
+
+		if route == "" {
+			route = "unmatched"
+		}
+
+		httpRequestDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Observe(time.Since(started).Seconds())
+	}
+}
+
+// recordDLLCall counts a failed call from dllWorker.call. Successful calls
+// only show up in the duration histogram
+func recordDLLCall(proc *syscall.LazyProc, r uintptr, err error) {
+	code := ""
+
+	switch {
+	case errors.Is(err, errCameraTimeout):
+		code = "timeout"
+	case errors.Is(err, errCameraClosed):
+		code = "closed"
+	case errors.Is(err, context.Canceled):
+		code = "canceled"
+	case err != nil:
+		code = "error"
+	case returnsHResult(proc) && r != 0 && r != errorRetry:
+		code = fmt.Sprintf("x%08x", uint32(r))
+	default:
+		return
+	}
+
+	dllCallFailures.WithLabelValues(proc.Name, code).Inc()
+}
+
+// recordPreviewServed counts a frame sent to a client
+func recordPreviewServed(transport string, info *imageInfo) {
+	previewFramesServed.WithLabelValues(transport).Inc()
+	bytesSent.WithLabelValues("preview").Add(float64(len(info.Data)))
+}
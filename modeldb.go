@@ -0,0 +1,146 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// modelSpec is what we know about a camera body without asking it. Pixel
+// sizes are in microns, as the DLL reports them
+type modelSpec struct {
+	Model        string  `json:"model"`
+	Name         string  `json:"name,omitempty"`
+	SensorWidth  uint32  `json:"sensorWidth"`
+	SensorHeight uint32  `json:"sensorHeight"`
+	PixelWidth   float64 `json:"pixelWidth"`
+	PixelHeight  float64 `json:"pixelHeight"`
+	BitsPerPixel uint32  `json:"bitsPerPixel"`
+	BayerPattern string  `json:"bayerPattern"`
+}
+
+//go:embed models.json
+var embeddedModels []byte
+
+var (
+	modelDatabaseOnce sync.Once
+	modelDatabase     map[string]modelSpec
+)
+
+// lookupModel finds a body in the database. Entries in models.json in the
+// settings directory replace the built in ones for the same model
+func lookupModel(model string) (modelSpec, bool) {
+	modelDatabaseOnce.Do(loadModelDatabase)
+
+	spec, ok := modelDatabase[strings.ToLower(strings.TrimSpace(model))]
+
+	return spec, ok
+}
+
+func loadModelDatabase() {
+	modelDatabase = map[string]modelSpec{}
+
+	if err := mergeModels(embeddedModels); err != nil {
+		panic(fmt.Sprintf("Built in model database is invalid: %s", err))
+	}
+
+	path, err := settingsPath("models.json")
+
+	if err != nil {
+		return
+	}
+
+	b, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+
+	if err == nil {
+		err = mergeModels(b)
+	}
+
+	if err != nil {
+		logWarnf("Ignoring model database %s: %s", path, err)
+	}
+}
+
+func mergeModels(b []byte) error {
+	var specs []modelSpec
+
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return err
+	}
+
+	for _, spec := range specs {
+		modelDatabase[strings.ToLower(spec.Model)] = spec
+	}
+
+	return nil
+}
+
+// fillFromModelDatabase fills in anything the camera reported as zero using
+// the database entry for its model, returning the names of the fields that
+// came from the database
+func fillFromModelDatabase(dInfo *deviceInfo, cInfo *camera) []string {
+	spec, ok := lookupModel(dInfo.Model)
+
+	if !ok {
+		return nil
+	}
+
+	var filled []string
+
+	if (cInfo.SensorImageWidth == 0 || cInfo.SensorImageHeight == 0) && spec.SensorWidth > 0 {
+		cInfo.SensorImageWidth = spec.SensorWidth
+		cInfo.SensorImageHeight = spec.SensorHeight
+		filled = append(filled, "sensorImageWidth", "sensorImageHeight")
+
+		// Zero offsets are a valid pattern, so they can only be assumed to be
+		// missing when the camera didn't know its own sensor either
+		if x, y, ok := bayerOffsets(spec.BayerPattern); ok {
+			cInfo.BayerXOffset = x
+			cInfo.BayerYOffset = y
+			filled = append(filled, "bayerPattern")
+		}
+	}
+
+	if (cInfo.CroppedImageWidth == 0 || cInfo.CroppedImageHeight == 0) && cInfo.SensorImageWidth > 0 {
+		cInfo.CroppedImageWidth = cInfo.SensorImageWidth
+		cInfo.CroppedImageHeight = cInfo.SensorImageHeight
+		filled = append(filled, "croppedImageWidth", "croppedImageHeight")
+	}
+
+	if (cInfo.PixelWidth == 0 || cInfo.PixelHeight == 0) && spec.PixelWidth > 0 {
+		cInfo.PixelWidth = spec.PixelWidth
+		cInfo.PixelHeight = spec.PixelHeight
+		filled = append(filled, "pixelWidth", "pixelHeight")
+	}
+
+	if dInfo.BitsPerPixel == 0 && spec.BitsPerPixel > 0 {
+		dInfo.BitsPerPixel = spec.BitsPerPixel
+		filled = append(filled, "bitsPerPixel")
+	}
+
+	return filled
+}
+
+// bayerOffsets is the reverse of bayerPattern
+func bayerOffsets(pattern string) (uint32, uint32, bool) {
+	switch strings.ToUpper(pattern) {
+	case "RGGB":
+		return 0, 0, true
+	case "GRBG":
+		return 1, 0, true
+	case "GBRG":
+		return 0, 1, true
+	case "BGGR":
+		return 1, 1, true
+	default:
+		return 0, 0, false
+	}
+}
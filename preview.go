@@ -0,0 +1,191 @@
+package main
+
+import (
+	"Sony/Web/winstruct"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	mimeJPEG = "image/jpeg"
+
+	liveViewBoundary   = "frame"
+	defaultLiveViewFPS = 10
+	maxLiveViewFPS     = 30
+
+	// previewWaitTimeout is how long /preview waits for the first frame when
+	// nobody else is watching the camera
+	previewWaitTimeout = 5 * time.Second
+)
+
+// previewImageMode is the format live-view frames are requested in
+var previewImageMode uint = imageModeJPEG
+
+// getPreviewImage returns the live-view JPEG directly so the URL can be used
+// as an <img src>. Clients that ask for JSON get the whole imageInfo as before
+func getPreviewImage(c *gin.Context) {
+	hCamera := getCameraHandleFromPath(c)
+
+	sub, err := subscribePreview(hCamera, defaultLiveViewFPS)
+
+	if err != nil {
+		c.IndentedJSON(http.StatusServiceUnavailable, errorResponse{Error: err.Error()})
+		return
+	}
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), previewWaitTimeout)
+	defer cancel()
+
+	frame, err := sub.Current(ctx)
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errPreviewStopped):
+		c.IndentedJSON(http.StatusGatewayTimeout, errorResponse{Error: "no preview frame available"})
+		return
+	case err != nil:
+		abortWithCameraError(c, err)
+		return
+	}
+
+	mime := previewMimeType()
+	recordPreviewServed("http", &frame.Info)
+
+	switch c.NegotiateFormat(mime, gin.MIMEJSON) {
+	case gin.MIMEJSON:
+		c.IndentedJSON(http.StatusOK, frame.Info)
+	default:
+		setFrameHeaders(c, frame)
+		c.Header("Cache-Control", "no-store")
+		c.Data(http.StatusOK, mime, frame.Info.Data)
+	}
+}
+
+// getLiveView streams preview frames as multipart/x-mixed-replace, which
+// browsers, VLC and OBS can all display directly. The frame rate can be
+// limited with ?fps=n
+func getLiveView(c *gin.Context) {
+	hCamera := getCameraHandleFromPath(c)
+
+	if previewImageMode != imageModeJPEG {
+		c.IndentedJSON(http.StatusConflict, errorResponse{Error: "live view streaming needs the preview image mode to be jpeg"})
+		return
+	}
+
+	fps, err := strconv.ParseFloat(c.DefaultQuery("fps", strconv.Itoa(defaultLiveViewFPS)), 64)
+
+	if err != nil || fps <= 0 {
+		c.IndentedJSON(http.StatusBadRequest, errorResponse{Error: "fps must be a positive number"})
+		return
+	}
+
+	if fps > maxLiveViewFPS {
+		fps = maxLiveViewFPS
+	}
+
+	sub, err := subscribePreview(hCamera, fps)
+
+	if err != nil {
+		c.IndentedJSON(http.StatusServiceUnavailable, errorResponse{Error: err.Error()})
+		return
+	}
+	defer sub.Close()
+
+	c.Header("Content-Type", "multipart/x-mixed-replace; boundary="+liveViewBoundary)
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / fps))
+	defer ticker.Stop()
+
+	var sequence uint64
+
+	for {
+		frame, err := sub.Next(c.Request.Context(), sequence)
+
+		if err != nil {
+			return
+		}
+
+		if err := writeLiveViewFrame(c, &frame.Info); err != nil {
+			previewFramesDropped.WithLabelValues("write_failed").Inc()
+			return
+		}
+
+		recordPreviewServed("mjpeg", &frame.Info)
+		sequence = frame.Sequence
+
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func writeLiveViewFrame(c *gin.Context, info *imageInfo) error {
+	w := c.Writer
+
+	_, err := fmt.Fprintf(w, "--%s\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n", liveViewBoundary, mimeJPEG, len(info.Data))
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(info.Data); err != nil {
+		return err
+	}
+
+	if _, err = w.Write([]byte("\r\n")); err != nil {
+		return err
+	}
+
+	w.Flush()
+
+	return nil
+}
+
+func fetchPreviewImage(ctx context.Context, hCamera uintptr) (imageInfo, error) {
+	info := imageInfo{ImageMode: previewImageMode}
+	buffer := winstruct.Marshal(&info)
+
+	if _, err := callCamera(ctx, hCamera, procGetPreviewImage, getPointerToSlice(buffer.Bytes())); err != nil {
+		return info, err
+	}
+
+	winstruct.Unmarshal(buffer, &info)
+
+	return info, nil
+}
+
+// previewMimeType is the content type of preview frames in the configured mode
+func previewMimeType() string {
+	if previewImageMode == imageModeJPEG {
+		return mimeJPEG
+	}
+
+	return "application/octet-stream"
+}
+
+// setFrameHeaders adds the pump sequence number and timestamp to the usual
+// image headers
+func setFrameHeaders(c *gin.Context, frame *previewFrame) {
+	setImageHeaders(c, &frame.Info)
+	c.Header("X-Frame-Sequence", strconv.FormatUint(frame.Sequence, 10))
+	c.Header("X-Frame-Timestamp", frame.Timestamp.Format(time.RFC3339Nano))
+}
+
+// setImageHeaders copies the interesting parts of an imageInfo into response
+// headers for endpoints that return the raw image bytes
+func setImageHeaders(c *gin.Context, info *imageInfo) {
+	c.Header("X-Image-Width", strconv.FormatUint(uint64(info.Width), 10))
+	c.Header("X-Image-Height", strconv.FormatUint(uint64(info.Height), 10))
+	c.Header("X-Image-Status", strconv.FormatUint(uint64(info.Status), 10))
+	c.Header("X-Image-Duration", strconv.FormatFloat(info.Duration, 'f', -1, 64))
+}
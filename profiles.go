@@ -0,0 +1,417 @@
+package main
+
+import (
+	"Sony/Web/winstruct"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cameraProfile is what has been learnt about a model the DLL doesn't know,
+// newer bodies report zeros for all of this until it has been supplied
+type cameraProfile struct {
+	Model              string    `json:"model"`
+	SensorImageWidth   uint32    `json:"sensorImageWidth"`
+	SensorImageHeight  uint32    `json:"sensorImageHeight"`
+	CroppedImageWidth  uint32    `json:"croppedImageWidth"`
+	CroppedImageHeight uint32    `json:"croppedImageHeight"`
+	PreviewWidth       uint32    `json:"previewWidth"`
+	PreviewHeight      uint32    `json:"previewHeight"`
+	BayerXOffset       uint32    `json:"bayerXOffset"`
+	BayerYOffset       uint32    `json:"bayerYOffset"`
+	PixelWidth         float64   `json:"pixelWidth"`
+	PixelHeight        float64   `json:"pixelHeight"`
+	Updated            time.Time `json:"updated"`
+}
+
+type profileApplyResponse struct {
+	Profile cameraProfile `json:"profile"`
+	Stored  bool          `json:"stored"`
+	Applied bool          `json:"applied"`
+	Error   string        `json:"error,omitempty"`
+}
+
+var (
+	profilesLock   sync.Mutex
+	profiles       map[string]cameraProfile
+	profilesLoaded bool
+)
+
+// getProfiles lists every stored profile
+func getProfiles(c *gin.Context) {
+	profilesLock.Lock()
+	defer profilesLock.Unlock()
+
+	if err := loadProfiles(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+
+	result := []cameraProfile{}
+
+	for _, p := range profiles {
+		result = append(result, p)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Model < result[j].Model })
+
+	c.IndentedJSON(http.StatusOK, result)
+}
+
+func getProfile(c *gin.Context) {
+	p, ok, err := lookupProfile(c.Param("model"))
+
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, errorResponse{Error: fmt.Sprintf("no profile for model %s", c.Param("model"))})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, p)
+}
+
+// putProfile stores a profile for a model. It is applied the next time a
+// camera of that model is opened
+func putProfile(c *gin.Context) {
+	in := cameraProfile{}
+
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	in.Model = c.Param("model")
+
+	p, err := checkProfile(in)
+
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	if p, err = saveProfile(p); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, p)
+}
+
+func deleteProfile(c *gin.Context) {
+	profilesLock.Lock()
+	defer profilesLock.Unlock()
+
+	if err := loadProfiles(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+
+	key := strings.ToLower(c.Param("model"))
+
+	if _, ok := profiles[key]; !ok {
+		c.IndentedJSON(http.StatusNotFound, errorResponse{Error: fmt.Sprintf("no profile for model %s", c.Param("model"))})
+		return
+	}
+
+	updated := copyProfiles()
+	delete(updated, key)
+
+	if err := writeProfiles(updated); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+
+	profiles = updated
+
+	c.IndentedJSON(http.StatusOK, emptyResponse{})
+}
+
+// putCameraProfile learns an open camera: the profile is stored against the
+// camera's model and handed to the DLL straight away. If the DLL doesn't take
+// it the profile stays stored, to be tried again the next time the camera is
+// opened
+func putCameraProfile(c *gin.Context) {
+	hCamera := getCameraHandleFromPath(c)
+	ctx := c.Request.Context()
+
+	in := cameraProfile{}
+
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	dInfo, _, err := fetchCameraInfo(ctx, hCamera)
+
+	if err != nil {
+		abortWithCameraError(c, err)
+		return
+	}
+
+	in.Model = dInfo.Model
+
+	p, err := checkProfile(in)
+
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	if p, err = saveProfile(p); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+
+	s := c.MustGet(sessionKey).(*session)
+
+	if err := applyProfile(ctx, s.worker, s.currentHandle(), p); err != nil {
+		c.IndentedJSON(cameraErrorStatus(err), profileApplyResponse{
+			Profile: p,
+			Stored:  true,
+			Error:   fmt.Sprintf("profile was stored but not applied, it will be tried again when the camera is next opened: %s", err),
+		})
+		return
+	}
+
+	invalidatePropertyDescriptors(hCamera)
+
+	c.IndentedJSON(http.StatusOK, profileApplyResponse{Profile: p, Stored: true, Applied: true})
+}
+
+// applyStoredProfile looks up the profile for the model behind a freshly
+// opened DLL handle and applies it, doing nothing if there isn't one
+func applyStoredProfile(ctx context.Context, w *dllWorker, dllHandle uintptr) error {
+	dInfo := deviceInfo{Version: 1}
+	buffer := winstruct.Marshal(&dInfo)
+
+	if _, err := w.call(ctx, procGetDeviceInfo, dllHandle, getPointerToSlice(buffer.Bytes())); err != nil {
+		return err
+	}
+
+	winstruct.Unmarshal(buffer, &dInfo)
+
+	p, ok, err := lookupProfile(dInfo.Model)
+
+	if err != nil || !ok {
+		return err
+	}
+
+	return applyProfile(ctx, w, dllHandle, p)
+}
+
+// applyProfile passes the learnt values to the DLL. CameraInfo is an in/out
+// structure, GetCameraInfo takes what is filled in when the camera is being
+// learnt and hands back what the DLL ends up using, which is checked so a
+// profile that didn't take isn't reported as applied
+func applyProfile(ctx context.Context, w *dllWorker, dllHandle uintptr, p cameraProfile) error {
+	info := camera{
+		SensorImageWidth:   p.SensorImageWidth,
+		SensorImageHeight:  p.SensorImageHeight,
+		CroppedImageWidth:  p.CroppedImageWidth,
+		CroppedImageHeight: p.CroppedImageHeight,
+		PreviewWidth:       p.PreviewWidth,
+		PreviewHeight:      p.PreviewHeight,
+		BayerXOffset:       p.BayerXOffset,
+		BayerYOffset:       p.BayerYOffset,
+		PixelWidth:         p.PixelWidth,
+		PixelHeight:        p.PixelHeight,
+	}
+	buffer := winstruct.Marshal(&info)
+
+	hr, err := w.call(ctx, procGetCameraInfo, dllHandle, getPointerToSlice(buffer.Bytes()))
+
+	if err != nil {
+		return err
+	}
+
+	if hr != 0 {
+		return fmt.Errorf("camera rejected profile for %s (error %d)", p.Model, hr)
+	}
+
+	result := camera{}
+	winstruct.Unmarshal(buffer, &result)
+
+	if result.SensorImageWidth != p.SensorImageWidth || result.SensorImageHeight != p.SensorImageHeight ||
+		result.PixelWidth != p.PixelWidth || result.PixelHeight != p.PixelHeight {
+		return fmt.Errorf("DLL did not take the profile for %s, it reports a %dx%d sensor with %gx%g pixels",
+			p.Model, result.SensorImageWidth, result.SensorImageHeight, result.PixelWidth, result.PixelHeight)
+	}
+
+	return nil
+}
+
+func lookupProfile(model string) (cameraProfile, bool, error) {
+	profilesLock.Lock()
+	defer profilesLock.Unlock()
+
+	if err := loadProfiles(); err != nil {
+		return cameraProfile{}, false, err
+	}
+
+	p, ok := profiles[strings.ToLower(model)]
+
+	return p, ok, nil
+}
+
+// checkProfile validates a profile, filling in the cropped size if it wasn't
+// given
+func checkProfile(p cameraProfile) (cameraProfile, error) {
+	p.Model = strings.TrimSpace(p.Model)
+
+	switch {
+	case p.Model == "":
+		return p, errors.New("camera did not report a model to store the profile against")
+	case p.SensorImageWidth == 0 || p.SensorImageHeight == 0:
+		return p, errors.New("sensorImageWidth and sensorImageHeight are required")
+	case p.PixelWidth <= 0 || p.PixelHeight <= 0:
+		return p, errors.New("pixelWidth and pixelHeight must be greater than zero")
+	case p.BayerXOffset > 1 || p.BayerYOffset > 1:
+		return p, errors.New("bayerXOffset and bayerYOffset must be 0 or 1")
+	case p.CroppedImageWidth > p.SensorImageWidth || p.CroppedImageHeight > p.SensorImageHeight:
+		return p, errors.New("cropped size cannot be larger than the sensor")
+	}
+
+	if p.CroppedImageWidth == 0 || p.CroppedImageHeight == 0 {
+		p.CroppedImageWidth = p.SensorImageWidth
+		p.CroppedImageHeight = p.SensorImageHeight
+	}
+
+	return p, nil
+}
+
+// saveProfile writes a profile that has been through checkProfile to disk
+func saveProfile(p cameraProfile) (cameraProfile, error) {
+	p.Updated = time.Now()
+
+	profilesLock.Lock()
+	defer profilesLock.Unlock()
+
+	if err := loadProfiles(); err != nil {
+		return p, err
+	}
+
+	updated := copyProfiles()
+	updated[strings.ToLower(p.Model)] = p
+
+	if err := writeProfiles(updated); err != nil {
+		return p, err
+	}
+
+	profiles = updated
+
+	return p, nil
+}
+
+// settingsPath returns the path of a file kept alongside the user's other
+// application settings
+func settingsPath(name string) (string, error) {
+	dir, err := os.UserConfigDir()
+
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "SonyCamGoAPI", name), nil
+}
+
+// loadProfiles reads the profiles the first time they are needed. Must be
+// called with profilesLock held
+func loadProfiles() error {
+	if profilesLoaded {
+		return nil
+	}
+
+	profiles = map[string]cameraProfile{}
+
+	path, err := settingsPath("profiles.json")
+
+	if err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		profilesLoaded = true
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var stored []cameraProfile
+
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return fmt.Errorf("unable to read %s: %w", path, err)
+	}
+
+	for _, p := range stored {
+		profiles[strings.ToLower(p.Model)] = p
+	}
+
+	profilesLoaded = true
+
+	return nil
+}
+
+// copyProfiles is where changes are made, so that profiles only changes once
+// they have been written. Must be called with profilesLock held
+func copyProfiles() map[string]cameraProfile {
+	result := make(map[string]cameraProfile, len(profiles))
+
+	for key, p := range profiles {
+		result[key] = p
+	}
+
+	return result
+}
+
+// writeProfiles saves every profile given, going through a temporary file so
+// a crash can't leave a half written one behind. Must be called with
+// profilesLock held
+func writeProfiles(profiles map[string]cameraProfile) error {
+	path, err := settingsPath("profiles.json")
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	stored := []cameraProfile{}
+
+	for _, p := range profiles {
+		stored = append(stored, p)
+	}
+
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Model < stored[j].Model })
+
+	b, err := json.MarshalIndent(stored, "", "    ")
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path+".tmp", b, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
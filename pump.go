@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// previewPumpLinger is how long a pump keeps polling after its last viewer
+// leaves, so clients polling /preview don't start and stop it every request
+const previewPumpLinger = 2 * time.Second
+
+var errPreviewStopped = errors.New("preview stopped")
+
+// previewFrame is a single frame produced by a pump. Frames are shared by
+// every viewer so must not be modified
+type previewFrame struct {
+	Sequence  uint64
+	Timestamp time.Time
+	Info      imageInfo
+}
+
+// previewPump is the single producer of preview frames for a camera. It runs
+// while there are subscribers and everyone viewing the camera is served the
+// latest frame from it rather than calling the DLL themselves
+type previewPump struct {
+	hCamera uintptr
+
+	lock        sync.Mutex
+	latest      *previewFrame
+	sequence    uint64
+	updated     chan struct{}
+	subscribers map[*previewSubscription]struct{}
+	idleSince   time.Time
+	stopped     bool
+	interval    time.Duration
+
+	// lastError is why the last fetch failed, cleared once the camera
+	// answers again
+	lastError error
+	failedAt  time.Time
+}
+
+type previewSubscription struct {
+	pump *previewPump
+	fps  float64
+}
+
+var (
+	previewPumpsLock sync.Mutex
+	previewPumps     = map[uintptr]*previewPump{}
+)
+
+// subscribePreview registers a viewer, starting the pump for the camera if
+// nobody else is watching it. fps is the fastest rate the viewer wants frames
+func subscribePreview(hCamera uintptr, fps float64) (*previewSubscription, error) {
+	previewPumpsLock.Lock()
+	defer previewPumpsLock.Unlock()
+
+	if shuttingDown.Load() {
+		return nil, errShuttingDown
+	}
+
+	p, ok := previewPumps[hCamera]
+
+	if !ok {
+		p = &previewPump{
+			hCamera:     hCamera,
+			updated:     make(chan struct{}),
+			subscribers: map[*previewSubscription]struct{}{},
+		}
+		previewPumps[hCamera] = p
+
+		go p.run()
+	}
+
+	s := &previewSubscription{pump: p, fps: fps}
+
+	p.lock.Lock()
+	p.subscribers[s] = struct{}{}
+	p.lock.Unlock()
+
+	return s, nil
+}
+
+// stopPreview shuts down the pump for a camera (if any), waking all viewers.
+// It returns how many viewers there were
+func stopPreview(hCamera uintptr) int {
+	previewPumpsLock.Lock()
+	defer previewPumpsLock.Unlock()
+
+	p, ok := previewPumps[hCamera]
+
+	if !ok {
+		return 0
+	}
+
+	p.lock.Lock()
+	viewers := len(p.subscribers)
+	p.lock.Unlock()
+
+	p.stop()
+
+	return viewers
+}
+
+func (s *previewSubscription) Close() {
+	p := s.pump
+
+	p.lock.Lock()
+	delete(p.subscribers, s)
+
+	if len(p.subscribers) == 0 {
+		p.idleSince = time.Now()
+	}
+	p.lock.Unlock()
+}
+
+// Next waits for a frame newer than the given sequence number. Passing 0
+// returns the latest frame straight away if there is one
+func (s *previewSubscription) Next(ctx context.Context, after uint64) (*previewFrame, error) {
+	p := s.pump
+
+	for {
+		p.lock.Lock()
+
+		if p.latest != nil && p.latest.Sequence > after {
+			frame := p.latest
+			p.lock.Unlock()
+			return frame, nil
+		}
+
+		if p.stopped {
+			p.lock.Unlock()
+			return nil, errPreviewStopped
+		}
+
+		updated := p.updated
+		p.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-updated:
+		}
+	}
+}
+
+// Current returns a frame for a one-off request. That is the latest frame if
+// it is recent, or the reason there isn't one if the camera is failing,
+// otherwise it waits for the pump to fetch one
+func (s *previewSubscription) Current(ctx context.Context) (*previewFrame, error) {
+	p := s.pump
+
+	for {
+		p.lock.Lock()
+		maxAge := p.maxAge()
+
+		if p.latest != nil && time.Since(p.latest.Timestamp) <= maxAge {
+			frame := p.latest
+			p.lock.Unlock()
+			return frame, nil
+		}
+
+		if p.lastError != nil && time.Since(p.failedAt) <= maxAge {
+			err := p.lastError
+			p.lock.Unlock()
+			return nil, err
+		}
+
+		if p.stopped {
+			p.lock.Unlock()
+			return nil, errPreviewStopped
+		}
+
+		updated := p.updated
+		p.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-updated:
+		}
+	}
+}
+
+// maxAge is how old a frame or error can get before it no longer says
+// anything about the camera, the pump should have fetched again by then.
+// Must be called with p.lock held
+func (p *previewPump) maxAge() time.Duration {
+	interval := p.interval
+
+	if interval == 0 {
+		interval = time.Second / defaultLiveViewFPS
+	}
+
+	return interval + operationTimeout(procGetPreviewImage.Name)
+}
+
+// run is the pump loop, fetching frames until nobody is watching
+func (p *previewPump) run() {
+	for {
+		interval, ok := p.nextInterval()
+
+		if !ok {
+			return
+		}
+
+		p.lock.Lock()
+		p.interval = interval
+		p.lock.Unlock()
+
+		started := time.Now()
+		info, err := fetchPreviewImage(context.Background(), p.hCamera)
+
+		// The camera returns no data while live-view is starting up. A failed
+		// call is just a missed frame to streams, which keep the last good
+		// one, but one-off requests are told why
+		switch {
+		case err != nil:
+			previewFramesDropped.WithLabelValues("fetch_failed").Inc()
+			p.failed(err)
+		case len(info.Data) == 0:
+			previewFramesDropped.WithLabelValues("empty").Inc()
+			p.failed(nil)
+		default:
+			p.publish(info)
+		}
+
+		if elapsed := time.Since(started); elapsed < interval {
+			time.Sleep(interval - elapsed)
+		}
+	}
+}
+
+// nextInterval works out how long to wait between frames based on the most
+// demanding viewer, or reports false if the pump should stop
+func (p *previewPump) nextInterval() (time.Duration, bool) {
+	previewPumpsLock.Lock()
+	defer previewPumpsLock.Unlock()
+
+	p.lock.Lock()
+	idle := len(p.subscribers) == 0 && time.Since(p.idleSince) > previewPumpLinger
+	stopped := p.stopped
+	p.lock.Unlock()
+
+	if stopped {
+		return 0, false
+	}
+
+	if idle {
+		p.stop()
+		return 0, false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	fps := 0.0
+
+	for s := range p.subscribers {
+		if s.fps > fps {
+			fps = s.fps
+		}
+	}
+
+	// Lingering with nobody watching
+	if fps == 0 {
+		fps = defaultLiveViewFPS
+	}
+
+	if fps > maxLiveViewFPS {
+		fps = maxLiveViewFPS
+	}
+
+	return time.Duration(float64(time.Second) / fps), true
+}
+
+func (p *previewPump) publish(info imageInfo) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// The camera may have been closed while the frame was being fetched
+	if p.stopped {
+		return
+	}
+
+	p.sequence++
+	p.latest = &previewFrame{Sequence: p.sequence, Timestamp: time.Now(), Info: info}
+	p.lastError = nil
+
+	close(p.updated)
+	p.updated = make(chan struct{})
+}
+
+// failed records a fetch that didn't produce a frame, err is nil if the
+// camera answered but had nothing to show. Anyone waiting in Current is woken
+// to see it
+func (p *previewPump) failed(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stopped {
+		return
+	}
+
+	p.lastError = err
+	p.failedAt = time.Now()
+
+	if err != nil {
+		close(p.updated)
+		p.updated = make(chan struct{})
+	}
+}
+
+// stop must be called with previewPumpsLock held
+func (p *previewPump) stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stopped {
+		return
+	}
+
+	p.stopped = true
+	close(p.updated)
+
+	if previewPumps[p.hCamera] == p {
+		delete(previewPumps, p.hCamera)
+	}
+}
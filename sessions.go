@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/gin-gonic/gin"
+)
+
+const sessionKey = "session"
+
+// errorInvalidHandle is returned by callCamera for a camera that isn't open
+const errorInvalidHandle = 6
+
+// sessionInfo is the part of a session reported to clients
+type sessionInfo struct {
+	Handle       uint64     `json:"handle"`
+	Alias        string     `json:"alias,omitempty"`
+	DeviceID     string     `json:"deviceId"`
+	Serial       string     `json:"serial,omitempty"`
+	Opened       time.Time  `json:"opened"`
+	Disconnected bool       `json:"disconnected"`
+	Reconnects   int        `json:"reconnects"`
+	LastError    string     `json:"lastError,omitempty"`
+	LastErrorAt  *time.Time `json:"lastErrorAt,omitempty"`
+	// Healthy is false after a call has timed out, until the worker finishes
+	// the call it is stuck in
+	Healthy        bool       `json:"healthy"`
+	UnhealthySince *time.Time `json:"unhealthySince,omitempty"`
+	// Calls counts every DLL call made for the camera, FailedCalls those
+	// that timed out or found the camera gone
+	Calls         int        `json:"calls"`
+	FailedCalls   int        `json:"failedCalls"`
+	LastSuccessAt *time.Time `json:"lastSuccessAt,omitempty"`
+}
+
+// session tracks a camera that has been opened through the API. Clients only
+// ever see our own handle (or alias), the DLL handle behind it changes each
+// time the camera has to be reopened after dropping off the bus
+type session struct {
+	sessionInfo
+
+	dllHandle uintptr
+	worker    *dllWorker
+	// applied holds every property value set through the API, so they can be
+	// restored when the camera is reopened
+	applied map[uint]uint
+
+	reconnectLock sync.Mutex
+}
+
+var (
+	sessionsLock      sync.Mutex
+	sessions          = map[uint64]*session{}
+	lastSessionHandle uint64
+)
+
+// CameraSession resolves the :handle path parameter (a handle or an alias)
+// to an open session, rejecting requests for cameras we don't know about
+func CameraSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := findSession(c.Param("handle"))
+
+		if s == nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, errorResponse{Error: fmt.Sprintf("no open camera with handle %s", c.Param("handle"))})
+			return
+		}
+
+		c.Set(sessionKey, s)
+		c.Next()
+	}
+}
+
+// getSessions lists the cameras currently open
+func getSessions(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, listSessions())
+}
+
+// getSession returns the session info for a single camera
+func getSession(c *gin.Context) {
+	s := c.MustGet(sessionKey).(*session)
+
+	c.IndentedJSON(http.StatusOK, s.info())
+}
+
+func addSession(worker *dllWorker, dllHandle uintptr, deviceID string, alias string) (sessionInfo, error) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	if alias != "" {
+		for _, s := range sessions {
+			if strings.EqualFold(s.Alias, alias) {
+				return sessionInfo{}, fmt.Errorf("alias %q is already in use by handle %d", alias, s.Handle)
+			}
+		}
+	}
+
+	lastSessionHandle++
+	s := &session{
+		sessionInfo: sessionInfo{
+			Handle:   lastSessionHandle,
+			Alias:    alias,
+			DeviceID: deviceID,
+			Serial:   serialFromDeviceId(deviceID),
+			Opened:   time.Now(),
+			Healthy:  true,
+		},
+		dllHandle: dllHandle,
+		worker:    worker,
+		applied:   map[uint]uint{},
+	}
+	sessions[s.Handle] = s
+
+	return s.sessionInfo, nil
+}
+
+// removeSession forgets a closed camera and stops its worker
+func removeSession(handle uint64) {
+	sessionsLock.Lock()
+	s, ok := sessions[handle]
+	delete(sessions, handle)
+	sessionsLock.Unlock()
+
+	if ok {
+		s.worker.stop()
+	}
+}
+
+func lookupSession(handle uint64) *session {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	return sessions[handle]
+}
+
+// findSession accepts either the numeric handle or the alias
+func findSession(handleOrAlias string) *session {
+	if handle, err := strconv.ParseUint(handleOrAlias, 10, 64); err == nil {
+		return lookupSession(handle)
+	}
+
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	for _, s := range sessions {
+		if s.Alias != "" && strings.EqualFold(s.Alias, handleOrAlias) {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func listSessions() []sessionInfo {
+	sessionsLock.Lock()
+	result := []sessionInfo{}
+
+	for _, s := range sessions {
+		result = append(result, s.sessionInfo)
+	}
+	sessionsLock.Unlock()
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Handle < result[j].Handle })
+
+	return result
+}
+
+func (s *session) info() sessionInfo {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	return s.sessionInfo
+}
+
+func (s *session) currentHandle() uintptr {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	return s.dllHandle
+}
+
+// recordCall counts a call made through callCamera
+func (s *session) recordCall(proc *syscall.LazyProc, r uintptr, err error) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	s.Calls++
+
+	if err != nil || (returnsHResult(proc) && isDisconnectError(r)) {
+		s.FailedCalls++
+		return
+	}
+
+	now := time.Now()
+	s.LastSuccessAt = &now
+}
+
+func (s *session) recordError(message string) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	now := time.Now()
+	s.LastError = message
+	s.LastErrorAt = &now
+}
+
+// markUnhealthy is called when a call has timed out. Until the worker gets
+// through the call, every other call fails straight away rather than queuing
+// up behind it
+func (s *session) markUnhealthy() {
+	sessionsLock.Lock()
+
+	if !s.Healthy {
+		sessionsLock.Unlock()
+		return
+	}
+
+	now := time.Now()
+	s.Healthy = false
+	s.UnhealthySince = &now
+	sessionsLock.Unlock()
+
+	go func() {
+		// This only runs once the stuck call has returned
+		if err := s.worker.do(context.Background(), func() {}); err != nil {
+			return
+		}
+
+		sessionsLock.Lock()
+		s.Healthy = true
+		s.UnhealthySince = nil
+		sessionsLock.Unlock()
+	}()
+}
+
+func (s *session) healthy() bool {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	return s.Healthy
+}
+
+func (s *session) recordApplied(id uint, value uint) {
+	sessionsLock.Lock()
+	s.applied[id] = value
+	sessionsLock.Unlock()
+}
+
+// reconnect reopens the camera after its DLL handle has stopped working. If
+// another caller has already reopened it since failedHandle was used there is
+// nothing to do
+func (s *session) reconnect(failedHandle uintptr) error {
+	s.reconnectLock.Lock()
+	defer s.reconnectLock.Unlock()
+
+	if s.currentHandle() != failedHandle {
+		return nil
+	}
+
+	// Reconnecting isn't tied to whichever request noticed the failure
+	ctx := context.Background()
+	devices, err := enumerateDevices(ctx)
+
+	if err != nil {
+		s.recordError(err.Error())
+		return err
+	}
+
+	sessionsLock.Lock()
+	var found *device
+
+	for i := range devices {
+		if s.matches(devices[i]) {
+			found = &devices[i]
+			break
+		}
+	}
+
+	// Only a camera missing from the bus counts as disconnected, one that is
+	// still there just gets reopened
+	if found == nil {
+		s.Disconnected = true
+	}
+
+	applied := map[uint]uint{}
+
+	for id, value := range s.applied {
+		applied[id] = value
+	}
+	sessionsLock.Unlock()
+
+	if found == nil {
+		err := errors.New("camera is not connected")
+		s.recordError(err.Error())
+		return err
+	}
+
+	// The old handle is useless now, but the DLL still has state for it
+	_, _ = s.worker.call(ctx, procCloseDevice, failedHandle)
+
+	hCamera, err := openDevice(ctx, s.worker, found.ID)
+
+	if err == nil && hCamera == 0 {
+		err = fmt.Errorf("unable to reopen %s", found.ID)
+	}
+
+	if err != nil {
+		s.recordError(err.Error())
+		return err
+	}
+
+	if err := applyStoredProfile(ctx, s.worker, hCamera); err != nil {
+		s.recordError(fmt.Sprintf("unable to apply camera profile after reconnect: %s", err))
+	}
+
+	for id, value := range applied {
+		if hr, err := s.worker.call(ctx, procSetPropertyValue, hCamera, id, value); err != nil || hr != 0 {
+			s.recordError(fmt.Sprintf("unable to restore property x%04x after reconnect (error %d)", id, hr))
+		}
+	}
+
+	sessionsLock.Lock()
+	s.dllHandle = hCamera
+	s.DeviceID = found.ID
+	s.Disconnected = false
+	s.Reconnects++
+	handle := s.Handle
+	sessionsLock.Unlock()
+
+	// The camera may have come back in a different mode
+	invalidatePropertyDescriptors(uintptr(handle))
+	publishCameraEvent(uintptr(handle), cameraEvent{Type: cameraEventConnected, Time: time.Now()})
+
+	return nil
+}
+
+// reconnectDevice reopens every disconnected session belonging to a device
+// that has just reappeared
+func reconnectDevice(d device) {
+	for _, handle := range disconnectedSessionsFor(d) {
+		if s := lookupSession(handle); s != nil {
+			_ = s.reconnect(s.currentHandle())
+		}
+	}
+}
+
+// markDeviceDisconnected flags every session open on a device as
+// disconnected, returning the affected handles
+func markDeviceDisconnected(d device) []uint64 {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	var handles []uint64
+
+	for _, s := range sessions {
+		if s.matches(d) && !s.Disconnected {
+			s.Disconnected = true
+			handles = append(handles, s.Handle)
+		}
+	}
+
+	return handles
+}
+
+// disconnectedSessionsFor returns the handles of disconnected sessions that
+// belong to a device that has just reappeared
+func disconnectedSessionsFor(d device) []uint64 {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	var handles []uint64
+
+	for _, s := range sessions {
+		if s.matches(d) && s.Disconnected {
+			handles = append(handles, s.Handle)
+		}
+	}
+
+	return handles
+}
+
+// matches checks the serial first, as the device path can change if the camera
+// is plugged into a different port. Must be called with sessionsLock held
+func (s *session) matches(d device) bool {
+	if serial := serialFromDeviceId(d.ID); serial != "" && s.Serial != "" {
+		return strings.EqualFold(serial, s.Serial)
+	}
+
+	return strings.EqualFold(s.DeviceID, d.ID)
+}
+
+// callCamera calls a DLL function whose first argument is the camera handle,
+// swapping our handle for the DLL one and running it on the camera's worker.
+// If the result says the camera has gone away it is reopened and the call
+// retried once. See dllArgs for the argument types allowed
+func callCamera(ctx context.Context, hCamera uintptr, proc *syscall.LazyProc, args ...any) (uintptr, error) {
+	s := lookupSession(uint64(hCamera))
+
+	if s == nil {
+		return errorInvalidHandle, errCameraClosed
+	}
+
+	if !s.healthy() {
+		return 0, errCameraUnhealthy
+	}
+
+	dllHandle := s.currentHandle()
+	r, err := s.worker.call(ctx, proc, append([]any{dllHandle}, args...)...)
+	s.recordCall(proc, r, err)
+
+	if errors.Is(err, errCameraTimeout) {
+		s.recordError(err.Error())
+		s.markUnhealthy()
+	}
+
+	if err != nil {
+		return r, err
+	}
+
+	if !returnsHResult(proc) || !isDisconnectError(r) {
+		return r, nil
+	}
+
+	s.recordError(fmt.Sprintf("%s failed (error x%08x)", proc.Name, uint32(r)))
+
+	if err := s.reconnect(dllHandle); err != nil {
+		return r, nil
+	}
+
+	r, err = s.worker.call(ctx, proc, append([]any{s.currentHandle()}, args...)...)
+	s.recordCall(proc, r, err)
+
+	return r, err
+}
+
+// returnsHResult is false for the few functions whose return value is not an
+// error code, they return a status, count or handle instead
+func returnsHResult(proc *syscall.LazyProc) bool {
+	switch proc {
+	case procCloseDevice, procGetCaptureStatus, procGetPortableDeviceCount, procOpenDeviceEx:
+		return false
+	default:
+		return true
+	}
+}
+
+// isDisconnectError recognizes the errors the DLL returns once the device
+// behind a handle has gone
+func isDisconnectError(r uintptr) bool {
+	switch uint32(r) {
+	case errorInvalidHandle, 0x80070006: // ERROR_INVALID_HANDLE
+		return true
+	case 1167, 0x8007048F: // ERROR_DEVICE_NOT_CONNECTED
+		return true
+	default:
+		return false
+	}
+}
+
+// openDevice opens a camera on the given worker, which will then be used for
+// every call made with the handle
+func openDevice(ctx context.Context, w *dllWorker, id string) (uintptr, error) {
+	sptr, _ := syscall.UTF16PtrFromString(id)
+
+	return w.call(ctx, procOpenDeviceEx, unsafe.Pointer(sptr), 0)
+}
+
+// serialFromDeviceId pulls the USB serial number out of a device path such as
+// \\?\usb#vid_054c&pid_0994#D0B8D06B2A3C#{6ac27878-a6fa-4155-ba85-f98f491d4f33}
+func serialFromDeviceId(id string) string {
+	parts := strings.Split(id, "#")
+
+	if len(parts) < 3 || !strings.Contains(strings.ToLower(parts[0]), "usb") {
+		return ""
+	}
+
+	// Windows makes up an id containing '&' for devices without a serial
+	if strings.Contains(parts[2], "&") {
+		return ""
+	}
+
+	return parts[2]
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// shuttingDown is set as soon as shutdown starts, after which no new streams
+// or websockets are accepted
+var shuttingDown atomic.Bool
+
+// closeReport is what was tidied up when a camera was closed
+type closeReport struct {
+	Handle          uint64 `json:"handle"`
+	CapturesAborted int    `json:"capturesAborted"`
+	StreamsEnded    int    `json:"streamsEnded"`
+	Error           string `json:"error,omitempty"`
+}
+
+// shutdownReport is logged once the server has stopped
+type shutdownReport struct {
+	Drained       bool
+	Streams       int
+	DeviceStreams int
+	WebSockets    int
+	Cameras       []closeReport
+	Took          time.Duration
+}
+
+// shutdown stops taking requests, ends the long running streams so the
+// requests serving them can finish, waits up to drainTimeout for everything
+// else, then closes every camera so none are left locked
+func shutdown(srv *http.Server, drainTimeout time.Duration) shutdownReport {
+	started := time.Now()
+	report := shutdownReport{}
+
+	// Before anything is stopped, so nothing new starts up behind us
+	shuttingDown.Store(true)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	drained := make(chan error, 1)
+
+	go func() { drained <- srv.Shutdown(drainCtx) }()
+
+	// Live view, event streams and long polls never finish on their own, the
+	// cameras are closed below once nothing else is using them
+	for _, s := range listSessions() {
+		report.Streams += stopPreview(uintptr(s.Handle)) + stopCameraEvents(uintptr(s.Handle))
+	}
+
+	report.DeviceStreams = closeDeviceSubscribers()
+
+	// Websockets have been hijacked from the server, so Shutdown neither
+	// waits for nor closes them
+	report.WebSockets = closeWebSockets()
+
+	err := <-drained
+	report.Drained = err == nil
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		logWarnf("Requests still running after %s, closing their connections", drainTimeout)
+		_ = srv.Close()
+	}
+
+	// Each DLL call still has its own timeout, so a stuck camera can't hold
+	// up the rest
+	for _, s := range listSessions() {
+		report.Cameras = append(report.Cameras, closeSession(context.Background(), uintptr(s.Handle)))
+	}
+
+	report.Took = time.Since(started)
+
+	return report
+}
+
+func (r shutdownReport) log() {
+	captures := 0
+	failed := 0
+
+	for _, camera := range r.Cameras {
+		captures += camera.CapturesAborted
+
+		if camera.Error != "" {
+			failed++
+			logWarnf("Camera %d did not close cleanly: %s", camera.Handle, camera.Error)
+		}
+	}
+
+	logInfof("Shutdown took %s: requests drained %t, %d camera(s) closed (%d with errors), %d capture(s) aborted, %d camera stream(s), %d device stream(s) and %d websocket(s) ended",
+		r.Took.Round(time.Millisecond), r.Drained, len(r.Cameras), failed, captures, r.Streams, r.DeviceStreams, r.WebSockets)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// defaultOperationTimeout applies to any DLL function not listed in
+	// operationTimeouts
+	defaultOperationTimeout = 10 * time.Second
+
+	errCameraTimeout   = errors.New("camera did not respond in time")
+	errCameraUnhealthy = errors.New("camera is not responding, waiting for it to recover")
+	errCameraClosed    = errors.New("camera has been closed")
+)
+
+// operationTimeouts is how long each DLL function is given before we stop
+// waiting for it, keyed by function name. Anything not listed gets
+// defaultOperationTimeout
+var operationTimeouts = map[string]time.Duration{
+	"GetPreviewImage":      5 * time.Second,
+	"GetAllPropertyValues": 10 * time.Second,
+	"GetCaptureStatus":     5 * time.Second,
+	"GetImage":             2 * time.Minute,
+	"CancelCapture":        30 * time.Second,
+	"OpenDeviceEx":         30 * time.Second,
+}
+
+func operationTimeout(name string) time.Duration {
+	if timeout, ok := operationTimeouts[name]; ok {
+		return timeout
+	}
+
+	return defaultOperationTimeout
+}
+
+// cameraErrorStatus picks the http status for an error from a camera call
+func cameraErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errCameraTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, errCameraUnhealthy), errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errCameraClosed):
+		return http.StatusNotFound
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func abortWithCameraError(c *gin.Context, err error) {
+	c.AbortWithStatusJSON(cameraErrorStatus(err), errorResponse{Error: err.Error()})
+}
+
+// parseOperationTimeouts reads overrides in the form
+// "GetImage=3m,GetPreviewImage=2s", "default" sets the fallback for anything
+// not listed
+func parseOperationTimeouts(spec string, timeouts *timeoutsConfig) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(entry, "=")
+
+		if !found {
+			return fmt.Errorf("timeout %q should be in the form Name=duration", entry)
+		}
+
+		timeout, err := time.ParseDuration(strings.TrimSpace(value))
+
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("timeout for %s must be a positive duration such as 5s", name)
+		}
+
+		if name = strings.TrimSpace(name); strings.EqualFold(name, "default") {
+			timeouts.Default = timeout
+		} else {
+			timeouts.Operations[name] = timeout
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Message types used on the websocket, in both directions
+const (
+	wsTypeCapture     = "capture"
+	wsTypeResult      = "result"
+	wsTypeError       = "error"
+	wsTypeLiveView    = "liveView"
+	wsTypeSetProperty = "setProperty"
+	wsTypeSetExposure = "setExposure"
+	wsTypeGetProperty = "getProperties"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	// Browsers don't apply CORS to websockets, so the same policy is checked
+	// here. Clients that aren't browsers don't send an Origin
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		_, ok := config.CORS.allowOrigin(origin)
+
+		return origin == "" || ok
+	},
+}
+
+// wsCommand is a request sent by the client. ID is echoed back in the result
+// so the client can match them up
+type wsCommand struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Lease is needed for commands that change the camera while someone
+	// holds a lease, if it wasn't given when connecting
+	Lease    string           `json:"lease"`
+	Property uint             `json:"property"`
+	Value    uint             `json:"value"`
+	Enabled  bool             `json:"enabled"`
+	FPS      float64          `json:"fps"`
+	Capture  captureRequest   `json:"capture"`
+	Exposure exposureSettings `json:"exposure"`
+}
+
+// wsEvent is a JSON message sent to the client, either in response to a
+// command or because something changed on the camera (using the same types
+// as cameraEvent). Preview frames are sent separately as binary messages
+// containing the JPEG
+type wsEvent struct {
+	Type       string            `json:"type"`
+	ID         string            `json:"id,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Properties []propertyValue   `json:"properties,omitempty"`
+	Capture    *capture          `json:"capture,omitempty"`
+	Exposure   *exposureResponse `json:"exposure,omitempty"`
+}
+
+type wsSession struct {
+	hCamera uintptr
+	caller  identity
+	lease   string
+	conn    *websocket.Conn
+	ctx     context.Context
+
+	// gorilla only allows one writer at a time
+	writeLock sync.Mutex
+
+	liveViewLock   sync.Mutex
+	liveViewCancel context.CancelFunc
+}
+
+var (
+	wsSessionsLock sync.Mutex
+	wsSessions     = map[*wsSession]struct{}{}
+)
+
+// getWebSocket upgrades to a websocket that carries live view, property and
+// capture updates to the client and accepts commands from it
+func getWebSocket(c *gin.Context) {
+	hCamera := getCameraHandleFromPath(c)
+
+	if shuttingDown.Load() {
+		c.IndentedJSON(http.StatusServiceUnavailable, errorResponse{Error: errShuttingDown.Error()})
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+
+	if err != nil {
+		// Upgrade has already written the error response
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	ws := &wsSession{hCamera: hCamera, caller: getIdentity(c), lease: c.Query("lease"), conn: conn, ctx: ctx}
+	defer ws.stopLiveView()
+
+	if !registerWebSocket(ws) {
+		ws.close(websocket.CloseGoingAway, errShuttingDown.Error())
+		return
+	}
+	defer unregisterWebSocket(ws)
+
+	go ws.watch()
+
+	for {
+		var cmd wsCommand
+
+		if err := conn.ReadJSON(&cmd); err != nil {
+			return
+		}
+
+		ws.handle(cmd)
+	}
+}
+
+func (ws *wsSession) handle(cmd wsCommand) {
+	// Anyone can watch, changing the camera needs the same role as the
+	// equivalent http endpoints
+	switch cmd.Type {
+	case wsTypeSetProperty, wsTypeSetExposure, wsTypeCapture:
+		if ws.caller.role < roleOperator {
+			ws.send(wsEvent{Type: wsTypeError, ID: cmd.ID, Error: fmt.Sprintf("%s role cannot do this", ws.caller.Role)})
+			return
+		}
+
+		id := cmd.Lease
+
+		if id == "" {
+			id = ws.lease
+		}
+
+		if l, ok := leaseAllows(ws.hCamera, id); !ok {
+			ws.send(wsEvent{Type: wsTypeError, ID: cmd.ID, Error: fmt.Sprintf("camera is leased by %s", l.Holder)})
+			return
+		}
+	}
+
+	switch cmd.Type {
+	case wsTypeLiveView:
+		if cmd.Enabled {
+			ws.startLiveView(cmd.FPS)
+		} else {
+			ws.stopLiveView()
+		}
+
+		ws.send(wsEvent{Type: wsTypeResult, ID: cmd.ID})
+	case wsTypeGetProperty:
+		result := wsEvent{Type: wsTypeResult, ID: cmd.ID}
+		properties, err := fetchPropertyValues(ws.ctx, ws.hCamera)
+
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Properties = properties
+		}
+
+		ws.send(result)
+	case wsTypeSetProperty:
+		result := wsEvent{Type: wsTypeResult, ID: cmd.ID}
+
+		if err := setPropertyValue(ws.ctx, ws.hCamera, cmd.Property, cmd.Value); err != nil {
+			result.Error = err.Error()
+		}
+
+		ws.send(result)
+	case wsTypeSetExposure:
+		exposure, err := applyExposure(ws.ctx, ws.hCamera, cmd.Exposure)
+		result := wsEvent{Type: wsTypeResult, ID: cmd.ID, Exposure: &exposure}
+
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		ws.send(result)
+	case wsTypeCapture:
+		result := wsEvent{Type: wsTypeResult, ID: cmd.ID}
+		cp, _, err := beginCapture(ws.ctx, ws.hCamera, cmd.Capture)
+
+		if cp != nil {
+			snapshot := cp.snapshot()
+			result.Capture = &snapshot
+		}
+
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		ws.send(result)
+	default:
+		ws.send(wsEvent{Type: wsTypeError, ID: cmd.ID, Error: "unknown command type " + cmd.Type})
+	}
+}
+
+// watch forwards property and capture changes to the client until the
+// connection closes
+func (ws *wsSession) watch() {
+	sub, err := subscribeCameraEvents(ws.hCamera)
+
+	if err != nil {
+		return
+	}
+	defer sub.Close()
+
+	for {
+		select {
+		case <-ws.ctx.Done():
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+
+			ws.send(wsEvent{Type: event.Type, Properties: event.Properties, Capture: event.Capture})
+		}
+	}
+}
+
+func (ws *wsSession) startLiveView(fps float64) {
+	if fps <= 0 {
+		fps = defaultLiveViewFPS
+	}
+
+	ws.stopLiveView()
+
+	ctx, cancel := context.WithCancel(ws.ctx)
+
+	ws.liveViewLock.Lock()
+	ws.liveViewCancel = cancel
+	ws.liveViewLock.Unlock()
+
+	go func() {
+		sub, err := subscribePreview(ws.hCamera, fps)
+
+		if err != nil {
+			ws.send(wsEvent{Type: wsTypeError, Error: err.Error()})
+			return
+		}
+		defer sub.Close()
+
+		interval := time.Duration(float64(time.Second) / fps)
+		var sequence uint64
+
+		for {
+			frame, err := sub.Next(ctx, sequence)
+
+			if err != nil {
+				return
+			}
+
+			ws.writeLock.Lock()
+			err = ws.conn.WriteMessage(websocket.BinaryMessage, frame.Info.Data)
+			ws.writeLock.Unlock()
+
+			if err != nil {
+				previewFramesDropped.WithLabelValues("write_failed").Inc()
+				return
+			}
+
+			recordPreviewServed("websocket", &frame.Info)
+			sequence = frame.Sequence
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// registerWebSocket tracks an open websocket so shutdown can close it,
+// returning false once shutdown has started
+func registerWebSocket(ws *wsSession) bool {
+	wsSessionsLock.Lock()
+	defer wsSessionsLock.Unlock()
+
+	if shuttingDown.Load() {
+		return false
+	}
+
+	wsSessions[ws] = struct{}{}
+
+	return true
+}
+
+func unregisterWebSocket(ws *wsSession) {
+	wsSessionsLock.Lock()
+	delete(wsSessions, ws)
+	wsSessionsLock.Unlock()
+}
+
+// closeWebSockets tells every client the server is going away and closes the
+// connection, which ends its handler. It returns how many there were
+func closeWebSockets() int {
+	wsSessionsLock.Lock()
+	defer wsSessionsLock.Unlock()
+
+	count := len(wsSessions)
+
+	for ws := range wsSessions {
+		ws.close(websocket.CloseGoingAway, errShuttingDown.Error())
+		delete(wsSessions, ws)
+	}
+
+	return count
+}
+
+// close sends a close message and drops the connection. gorilla allows
+// WriteControl alongside another writer, so a stuck frame write doesn't hold
+// this up
+func (ws *wsSession) close(code int, reason string) {
+	_ = ws.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	_ = ws.conn.Close()
+}
+
+func (ws *wsSession) stopLiveView() {
+	ws.liveViewLock.Lock()
+	defer ws.liveViewLock.Unlock()
+
+	if ws.liveViewCancel != nil {
+		ws.liveViewCancel()
+		ws.liveViewCancel = nil
+	}
+}
+
+func (ws *wsSession) send(event wsEvent) {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+
+	_ = ws.conn.WriteJSON(event)
+}
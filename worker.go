@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/go-ole/go-ole"
+)
+
+// dllWorker owns an OS thread that has COM initialized on it, and runs DLL
+// calls there one at a time. Each open camera gets its own worker so the
+// DLL is never called concurrently for a handle, and everything else (device
+// enumeration) goes through systemWorker
+type dllWorker struct {
+	name           string
+	jobs           chan func()
+	quit           chan struct{}
+	stopOnce       sync.Once
+	comInitialized bool
+}
+
+var systemWorker *dllWorker
+
+// startDLLWorker starts the worker thread and waits for COM to be set up on it
+func startDLLWorker(name string) *dllWorker {
+	w := &dllWorker{name: name, jobs: make(chan func()), quit: make(chan struct{})}
+	ready := make(chan struct{})
+
+	go w.run(ready)
+	<-ready
+
+	return w
+}
+
+func (w *dllWorker) run(ready chan struct{}) {
+	// The thread is never unlocked, when the goroutine exits the runtime
+	// throws the thread away along with its COM state
+	runtime.LockOSThread()
+
+	if err := ole.CoInitialize(0); err != nil {
+		logErrorf("Worker %s unable to initialize COM: %s", w.name, err)
+	} else {
+		w.comInitialized = true
+		defer ole.CoUninitialize()
+	}
+
+	close(ready)
+
+	for {
+		select {
+		case job := <-w.jobs:
+			job()
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// do runs f on the worker thread and waits for it to complete, or for the
+// context to be done. A DLL call can't be interrupted, so if the context
+// expires first f carries on running and the worker stays busy until it
+// returns. A panic in f is passed back to the caller rather than killing the
+// worker
+func (w *dllWorker) do(ctx context.Context, f func()) error {
+	done := make(chan any, 1)
+
+	job := func() {
+		defer func() { done <- recover() }()
+		f()
+	}
+
+	select {
+	case w.jobs <- job:
+	case <-w.quit:
+		return errCameraClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case p := <-done:
+		if p != nil {
+			panic(p)
+		}
+
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// call runs a single DLL function on the worker, giving up once the timeout
+// for that function has passed. Every call into the DLL comes through here,
+// so this is where they are measured. See dllArgs for the argument types
+// allowed
+func (w *dllWorker) call(ctx context.Context, proc *syscall.LazyProc, args ...any) (uintptr, error) {
+	r, err := w.callWithTimeout(ctx, proc, args...)
+	recordDLLCall(proc, r, err)
+
+	return r, err
+}
+
+func (w *dllWorker) callWithTimeout(ctx context.Context, proc *syscall.LazyProc, args ...any) (uintptr, error) {
+	ctx, cancel := context.WithTimeout(ctx, operationTimeout(proc.Name))
+	defer cancel()
+
+	result := make(chan uintptr, 1)
+
+	err := w.do(ctx, func() {
+		started := time.Now()
+		r, _, _ := proc.Call(dllArgs(args)...)
+		dllCallDuration.WithLabelValues(proc.Name).Observe(time.Since(started).Seconds())
+
+		runtime.KeepAlive(args)
+		result <- r
+	})
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 0, fmt.Errorf("%w: %s", errCameraTimeout, proc.Name)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return <-result, nil
+}
+
+// dllArgs converts arguments to uintptr at the last moment. Anything the DLL
+// writes to must be passed as an unsafe.Pointer rather than a uintptr, as the
+// call happens on another goroutine and a bare uintptr doesn't stop the
+// caller's stack (and the variable on it) from moving in the meantime, or a
+// buffer from being freed once a caller that timed out has dropped it. The
+// job holds on to args until the DLL returns, however long that takes
+func dllArgs(args []any) []uintptr {
+	result := make([]uintptr, len(args))
+
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case uintptr:
+			result[i] = v
+		case unsafe.Pointer:
+			result[i] = uintptr(v)
+		case int:
+			result[i] = uintptr(v)
+		case uint:
+			result[i] = uintptr(v)
+		default:
+			panic(fmt.Sprintf("Unsupported DLL argument type %T", arg))
+		}
+	}
+
+	return result
+}
+
+// stop ends the worker once any job already running has finished
+func (w *dllWorker) stop() {
+	w.stopOnce.Do(func() { close(w.quit) })
+}